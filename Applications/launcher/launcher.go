@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
-	"github.com/jonas747/dcmd"
 	"github.com/jonas747/drai"
 	"github.com/jonas747/drai/Applications/tictactoe"
+	"github.com/jonas747/drai/commands"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -17,10 +20,10 @@ import (
 var (
 	engine  *drai.Engine
 	session *discordgo.Session
-
-	cmdSys *dcmd.System
 )
 
+const cmdPrefix = "!g"
+
 func debugSrv() {
 	err := http.ListenAndServe(":5000", nil)
 	if err != nil {
@@ -42,27 +45,58 @@ func main() {
 		logrus.WithError(err).Fatal("Failed creating discordgo session")
 	}
 
+	// Handlers are called in the order the events arrived, so instances get them in order aswell
+	session.SyncEvents = true
+	// Privileged, needed for the commands and MessageApp's to see what was written
+	session.Identify.Intents |= discordgo.IntentsMessageContent
+
 	engine = drai.NewEngine()
+	// With SyncEvents a blocking full queue would hold up every other event, so drop instead
+	engine.QueuePolicy = drai.QueuePolicyDropNewest
+	engine.IdleWarning = time.Second * 30
+	engine.CheckpointInterval = time.Minute
+
+	// Buttons and select menus are quicker to show than reactions
+	switch os.Getenv("DRAI_TRANSPORT") {
+	case "buttons":
+		engine.Transport = drai.TransportButtons
+	case "select":
+		engine.Transport = drai.TransportSelectMenu
+	}
+
 	session.AddHandler(engine.HandleMessageReactionAdd)
+	session.AddHandler(engine.HandleMessageReactionRemove)
+	session.AddHandler(engine.HandleMessageCreate)
+	session.AddHandler(engine.HandleMessageDelete)
+	session.AddHandler(engine.HandleMessageDeleteBulk)
+	session.AddHandler(engine.HandleChannelDelete)
+	session.AddHandler(engine.HandleGuildDelete)
+	session.AddHandler(engine.HandleInteractionCreate)
 
-	cmdSys := dcmd.NewStandardSystem("!g")
-	cmdSys.Root.AddCommand(dcmd.NewStdHelpCommand(), dcmd.NewTrigger("help"))
-	cmdSys.Root.AddCommand(cmdTicTacToe, dcmd.NewTrigger("tictactoe", "ttc"))
+	session.AddHandler(handleCommand)
 
-	session.AddHandler(cmdSys.HandleMessageCreate)
+	// Slash commands for all apps that have one
+	appCmds := commands.New(engine)
+	session.AddHandler(appCmds.HandleInteractionCreate)
 
 	err = engine.RestoreApps(session)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed restoring apps")
 	}
 
-	go engine.Run()
+	go engine.Run(context.Background())
 
 	err = session.Open()
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed Connecting to discord")
 	}
 
+	// Guild commands show up right away, global ones can take a while
+	err = appCmds.Register(session, session.State.User.ID, os.Getenv("DRAI_COMMANDS_GUILD"))
+	if err != nil {
+		logrus.WithError(err).Error("Failed registering app commands")
+	}
+
 	logrus.Println("Bot is now running.  Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
@@ -77,11 +111,104 @@ func main() {
 	}
 }
 
-var cmdTicTacToe = &dcmd.SimpleCmd{
+// command is a text command, used by sending "!g <name> [args...]"
+type command struct {
+	Names        []string
+	ShortDesc    string
+	Usage        string
+	RequiredArgs int
+	RunFunc      func(data *cmdData) (string, error)
+}
+
+// cmdData is a use of a command
+type cmdData struct {
+	Session   *discordgo.Session
+	Msg       *discordgo.Message
+	GuildID   string
+	ChannelID string
+
+	// The words after the command name
+	Args []string
+}
+
+var commandList []*command
+
+func init() {
+	// Set here since the help command lists the others
+	commandList = []*command{cmdHelp, cmdTicTacToe, cmdApps, cmdStop}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commandList {
+		for _, n := range cmd.Names {
+			if strings.EqualFold(n, name) {
+				return cmd
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleCommand is added as a discord handler, running the command the message is using if any
+func handleCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author == nil || m.Author.Bot || m.GuildID == "" {
+		return
+	}
+
+	fields := strings.Fields(m.Content)
+	if len(fields) < 2 || fields[0] != cmdPrefix {
+		return
+	}
+
+	cmd := findCommand(fields[1])
+	if cmd == nil {
+		return
+	}
+
+	data := &cmdData{
+		Session:   s,
+		Msg:       m.Message,
+		GuildID:   m.GuildID,
+		ChannelID: m.ChannelID,
+		Args:      fields[2:],
+	}
+
+	var reply string
+	if len(data.Args) < cmd.RequiredArgs {
+		reply = "Usage: `" + cmdPrefix + " " + cmd.Names[0] + " " + cmd.Usage + "`"
+	} else {
+		var err error
+		reply, err = cmd.RunFunc(data)
+		if err != nil {
+			logrus.WithError(err).WithField("command", cmd.Names[0]).Error("Failed running command")
+		}
+	}
+
+	if reply != "" {
+		s.ChannelMessageSend(m.ChannelID, reply)
+	}
+}
+
+var cmdHelp = &command{
+	Names:     []string{"help"},
+	ShortDesc: "List the commands",
+	RunFunc: func(data *cmdData) (string, error) {
+		out := "Commands:\n"
+		for _, cmd := range commandList {
+			out += fmt.Sprintf("`%s %s %s` %s\n", cmdPrefix, strings.Join(cmd.Names, "/"), cmd.Usage, cmd.ShortDesc)
+		}
+
+		return out, nil
+	},
+}
+
+var cmdTicTacToe = &command{
+	Names:     []string{"tictactoe", "ttc"},
 	ShortDesc: "Play tic tac toe",
-	RunFunc: func(data *dcmd.Data) (interface{}, error) {
+	RunFunc: func(data *cmdData) (string, error) {
 		game := tictactoe.NewGame(data.Msg.Author)
-		_, err := engine.StartApp(data.Session, game, data.Guild.ID, data.Channel.ID, time.Minute)
+		_, err := engine.StartApp(data.Session, game, data.GuildID, data.ChannelID, time.Minute)
 		if err != nil {
 			logrus.WithError(err).Error("Failed starting tic tac toe :(")
 			return "Failed starting :(", err
@@ -89,3 +216,70 @@ var cmdTicTacToe = &dcmd.SimpleCmd{
 		return "", nil
 	},
 }
+
+var cmdApps = &command{
+	Names:     []string{"apps"},
+	ShortDesc: "List the apps running in this channel",
+	RunFunc: func(data *cmdData) (string, error) {
+		instances := engine.FindByChannel(data.ChannelID)
+		if len(instances) < 1 {
+			return "No apps running in this channel", nil
+		}
+
+		out := "Apps running in this channel:\n"
+		for _, v := range instances {
+			out += fmt.Sprintf("`#%s` %T\n", v.ID, v.App)
+		}
+
+		return out, nil
+	},
+}
+
+var cmdStop = &command{
+	Names:        []string{"stop"},
+	ShortDesc:    "Stop a app running in this channel",
+	Usage:        "<ID>",
+	RequiredArgs: 1,
+	RunFunc: func(data *cmdData) (string, error) {
+		id := strings.TrimPrefix(data.Args[0], "#")
+
+		// Don't allow stopping apps in other channels
+		inst := engine.FindByID(id)
+		if inst == nil || inst.ChannelID != data.ChannelID {
+			return "No app with that id running in this channel", nil
+		}
+
+		// Only the users of the app and moderators may stop it
+		if !isInstanceUser(inst, data.Msg.Author.ID) {
+			perms, err := data.Session.UserChannelPermissions(data.Msg.Author.ID, data.ChannelID)
+			if err != nil {
+				return "Failed checking your permissions", err
+			}
+
+			if perms&discordgo.PermissionManageMessages == 0 {
+				return "Only the users of that app, or someone with Manage Messages, can stop it", nil
+			}
+		}
+
+		err := engine.StopInstance(id)
+		if err != nil {
+			return "Failed stopping app", err
+		}
+
+		return "Stopped app #" + id, nil
+	},
+}
+
+// isInstanceUser returns true if the user is whitelisted on the instance by id, AllowAllUsers doesn't count
+func isInstanceUser(inst *drai.Instance, userID string) bool {
+	inst.RLock()
+	defer inst.RUnlock()
+
+	for _, v := range inst.UserIDs {
+		if v == userID {
+			return true
+		}
+	}
+
+	return false
+}
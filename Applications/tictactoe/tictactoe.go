@@ -1,38 +1,33 @@
 package tictactoe
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/jonas747/drai"
+	"github.com/jonas747/drai/commands"
 	"time"
 )
 
-func init() {
-	drai.RegisterApp("github.com/jonas747/drai/tictactoe", &Game{})
-}
+const ActionMove = "github.com/jonas747/drai/tictactoe.move"
 
-func (g *Game) SerializeState() ([]byte, error) {
-	return json.Marshal(g)
+func init() {
+	drai.RegisterApp("github.com/jonas747/drai/tictactoe", &Game{}, 1)
+	drai.RegisterActionHandler(ActionMove, handleMove)
 }
 
-func (g *Game) LoadState(instance *drai.Instance, data []byte) error {
-	err := json.Unmarshal(data, g)
-	if err != nil {
-		return err
-	}
-
-	g.Instance = instance
-
+// Called after the state has been loaded, the instance fields are already set
+func (g *Game) AfterLoad(instance *drai.Instance) error {
 	if g.UserFinder != nil {
 		g.UserFinder.UsersFoundCB = g.onUsersFound
-		g.UserFinder.Instance = instance
 	}
 
 	return nil
 }
 
 type Game struct {
+	drai.AppState[Game]
+
 	Instance *drai.Instance `json:"-"`
 
 	UserFinder *drai.UserFinder
@@ -64,13 +59,53 @@ func NewGame(author *discordgo.User) *Game {
 	}
 }
 
+// Command is the application command starting a game, see the commands package
+func (g *Game) Command() *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:        "tictactoe",
+		Description: "Play tic tac toe",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionUser,
+				Name:        "opponent",
+				Description: "Who to play against, anyone can join if not set",
+			},
+		},
+	}
+}
+
+func (g *Game) NewFromCommand(inv *commands.Invocation) (drai.App, error) {
+	game := NewGame(inv.Author)
+
+	opponent := inv.User("opponent")
+	if opponent != nil {
+		if opponent.ID == inv.Author.ID {
+			return nil, errors.New("You can't play against yourself")
+		}
+
+		if opponent.Bot {
+			return nil, errors.New("Bots don't play tic tac toe")
+		}
+
+		game.Player2 = opponent
+	}
+
+	return game, nil
+}
+
 // Called by engine when starting
 func (g *Game) Start(instance *drai.Instance) error {
 	g.Instance = instance
 
+	users := []*discordgo.User{g.Player1}
+	if g.Player2 != nil {
+		// Picked when starting the game, no need to wait for someone to join
+		users = append(users, g.Player2)
+	}
+
 	g.UserFinder = &drai.UserFinder{
 		Instance:       instance,
-		Users:          []*discordgo.User{g.Player1},
+		Users:          users,
 		NumUsersToFind: 2,
 		UsersFoundCB:   g.onUsersFound,
 	}
@@ -96,9 +131,41 @@ func (g *Game) Start(instance *drai.Instance) error {
 }
 
 // Perform cleanup here
-func (g *Game) Exit(instance *drai.Instance) error {
+func (g *Game) Exit(instance *drai.Instance, reason drai.ExitReason) error {
+	if reason == drai.ExitChannelGone {
+		// Nothing left to clean up
+		return nil
+	}
+
 	g.Instance.ClearActions()
-	return nil
+
+	if reason == drai.ExitCompleted {
+		// The board already shows the winner
+		return nil
+	}
+
+	if reason == drai.ExitMessageDeleted {
+		// The board may be gone, so say it in a new message
+		_, err := g.Instance.Session.ChannelMessageSend(g.Instance.ChannelID, "Game abandoned, the board was deleted.")
+		return err
+	}
+
+	// Don't leave a stale board around that looks like it's still being played
+	content := "Game abandoned."
+	switch reason {
+	case drai.ExitTimeout:
+		content = "Game abandoned, nobody made a move in time."
+	case drai.ExitError:
+		content = "Game abandoned, something went wrong."
+	}
+
+	msgID := g.M1
+	if !g.UsersFound {
+		msgID = g.UserFinder.MessageID
+	}
+
+	_, err := g.Instance.Session.ChannelMessageEdit(g.Instance.ChannelID, msgID, content)
+	return err
 }
 
 func (g *Game) UpdateMessage() {
@@ -125,6 +192,18 @@ func (g *Game) UpdateMessage() {
 	g.Instance.Session.ChannelMessageEdit(g.Instance.ChannelID, g.M1, content)
 }
 
+// Called by the engine when the game is about to time out
+func (g *Game) HandleIdleWarning(remaining time.Duration) (bool, error) {
+	// Whether reactions or buttons are used, joining or moving is what keeps it open
+	what := "makes a move"
+	if !g.UsersFound {
+		what = "joins"
+	}
+
+	_, err := g.Instance.Session.ChannelMessageSend(g.Instance.ChannelID, fmt.Sprintf("This game will close in %s unless someone %s.", remaining.Round(time.Second), what))
+	return false, err
+}
+
 func (g *Game) TurnPlayer(turn int) *discordgo.User {
 	var nextTurn *discordgo.User
 	if turn%2 == 0 {
@@ -196,6 +275,11 @@ func (g *Game) onUsersFound(users []*discordgo.User) {
 	// Reuse this message
 	g.M1 = g.UserFinder.MessageID
 
+	// Only the players may touch the board from now on
+	g.Instance.AllowAllUsers = false
+	g.Instance.ClearUsers()
+	g.Instance.AddUsers([]string{g.Player1.ID, g.Player2.ID})
+
 	g.Instance.ClearActions()
 
 	for i := 0; i < 9; i++ {
@@ -208,8 +292,12 @@ func (g *Game) onUsersFound(users []*discordgo.User) {
 		}
 
 		a := &drai.Action{
-			Emoji:     Emojis[i],
+			Emoji:     drai.UnicodeEmoji(Emojis[i]),
 			MessageID: mID,
+			Name:      ActionMove,
+
+			RemoveReactionOnSuccess:      true,
+			RemoveReactionNotWhitelisted: true,
 		}
 
 		a.Set("index", i)
@@ -222,16 +310,31 @@ func (g *Game) onUsersFound(users []*discordgo.User) {
 }
 
 func (g *Game) HandleAction(userID string, action *drai.Action) error {
-	if handled, err := g.UserFinder.HandleAction(userID, action); handled {
-		g.Instance.LastAction = time.Now()
+	return g.HandleActionToggle(userID, action, true)
+}
+
+func (g *Game) HandleActionToggle(userID string, action *drai.Action, added bool) error {
+	if handled, err := g.UserFinder.HandleActionToggle(userID, action, added); handled {
 		return err
 	}
 
+	if !added {
+		return nil
+	}
+
+	// Board actions from games saved before they were bound to ActionMove end up here
+	return g.move(userID, action)
+}
+
+func handleMove(instance *drai.Instance, userID string, action *drai.Action) error {
+	return instance.App.(*Game).move(userID, action)
+}
+
+func (g *Game) move(userID string, action *drai.Action) error {
 	cPlayer := g.TurnPlayer(g.CurrentTurn)
 	if cPlayer.ID != userID {
 		return nil
 	}
-	g.Instance.LastAction = time.Now()
 
 	symbol := "O"
 	if cPlayer == g.Player2 {
@@ -248,7 +351,7 @@ func (g *Game) HandleAction(userID string, action *drai.Action) error {
 	g.UpdateMessage()
 
 	if g.CheckForWinner() != nil {
-		g.Instance.Exit()
+		g.Instance.Exit(drai.ExitCompleted)
 	}
 
 	return nil
@@ -0,0 +1,201 @@
+package drai
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+)
+
+// AccessRules restricts who may use a instance or a single action, by user, guild role or discord permission
+// Deny rules always take precedence over allow rules
+type AccessRules struct {
+	AllowUsers []string `json:"allow_users,omitempty"`
+	DenyUsers  []string `json:"deny_users,omitempty"`
+
+	AllowRoles []string `json:"allow_roles,omitempty"`
+	DenyRoles  []string `json:"deny_roles,omitempty"`
+
+	// Users with all of these permissions in the instance's channel are allowed, e.g discordgo.PermissionManageMessages
+	AllowPermissions int64 `json:"allow_permissions,omitempty"`
+	// Users with any of these permissions in the instance's channel are denied
+	DenyPermissions int64 `json:"deny_permissions,omitempty"`
+}
+
+func (a *AccessRules) copy() *AccessRules {
+	if a == nil {
+		return nil
+	}
+
+	// The slices are copied aswell, so saved states don't share them with the running instance
+	cop := *a
+	cop.AllowUsers = append([]string(nil), a.AllowUsers...)
+	cop.DenyUsers = append([]string(nil), a.DenyUsers...)
+	cop.AllowRoles = append([]string(nil), a.AllowRoles...)
+	cop.DenyRoles = append([]string(nil), a.DenyRoles...)
+	return &cop
+}
+
+// HasAllowRules returns true if any allow rules are set, meaning users not matching them are not allowed
+func (a *AccessRules) HasAllowRules() bool {
+	return len(a.AllowUsers) > 0 || len(a.AllowRoles) > 0 || a.AllowPermissions != 0
+}
+
+// denies returns true if the user matches any of the deny rules
+func (a *AccessRules) denies(user *accessUser) bool {
+	if containsString(a.DenyUsers, user.id) {
+		return true
+	}
+
+	if len(a.DenyRoles) > 0 {
+		roles, ok := user.roles()
+		if !ok {
+			// Fail closed
+			return true
+		}
+
+		for _, r := range roles {
+			if containsString(a.DenyRoles, r) {
+				return true
+			}
+		}
+	}
+
+	if a.DenyPermissions != 0 {
+		perms, ok := user.permissions()
+		if !ok || perms&a.DenyPermissions != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows returns true if the user matches any of the allow rules
+func (a *AccessRules) allows(user *accessUser) bool {
+	if containsString(a.AllowUsers, user.id) {
+		return true
+	}
+
+	if len(a.AllowRoles) > 0 {
+		roles, _ := user.roles()
+		for _, r := range roles {
+			if containsString(a.AllowRoles, r) {
+				return true
+			}
+		}
+	}
+
+	if a.AllowPermissions != 0 {
+		perms, ok := user.permissions()
+		if ok && perms&a.AllowPermissions == a.AllowPermissions {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accessUser lazily looks up the roles and permissions of a user, so they're only fetched if a rule needs them
+type accessUser struct {
+	session   Session
+	guildID   string
+	channelID string
+	id        string
+
+	rolesFetched bool
+	rolesOK      bool
+	cachedRoles  []string
+
+	permsFetched bool
+	permsOK      bool
+	cachedPerms  int64
+}
+
+func (u *accessUser) roles() ([]string, bool) {
+	if u.rolesFetched {
+		return u.cachedRoles, u.rolesOK
+	}
+	u.rolesFetched = true
+
+	roles, err := memberRoles(u.session, u.guildID, u.id)
+	if err != nil {
+		logrus.WithError(err).WithField("user", u.id).Error("Failed retrieving member for access rules")
+		return nil, false
+	}
+
+	u.cachedRoles = roles
+	u.rolesOK = true
+	return u.cachedRoles, true
+}
+
+// memberRoles returns the roles of the member, looking in the state first if the session has one
+// since discordgo's GuildMember always makes a request
+func memberRoles(session Session, guildID, userID string) ([]string, error) {
+	if ds, ok := session.(*discordgo.Session); ok && ds.StateEnabled && ds.State != nil {
+		member, err := ds.State.Member(guildID, userID)
+		if err == nil {
+			// The state may update the member while we're using it
+			ds.State.RLock()
+			roles := append([]string(nil), member.Roles...)
+			ds.State.RUnlock()
+			return roles, nil
+		}
+	}
+
+	member, err := session.GuildMember(guildID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return member.Roles, nil
+}
+
+func (u *accessUser) permissions() (int64, bool) {
+	if u.permsFetched {
+		return u.cachedPerms, u.permsOK
+	}
+	u.permsFetched = true
+
+	perms, err := u.session.UserChannelPermissions(u.id, u.channelID)
+	if err != nil {
+		logrus.WithError(err).WithField("user", u.id).Error("Failed retrieving permissions for access rules")
+		return 0, false
+	}
+
+	u.cachedPerms = perms
+	u.permsOK = true
+	return perms, true
+}
+
+// checkAccess returns true if the user may use the action
+// A user has to be either whitelisted on the instance or allowed by the instance's access rules,
+// then if the action has allow rules the user has to match one of those aswell
+// Being denied by either the instance or the action always wins
+func checkAccess(user *accessUser, whitelisted bool, instanceRules, actionRules *AccessRules) bool {
+	if instanceRules != nil && instanceRules.denies(user) {
+		return false
+	}
+
+	if actionRules != nil && actionRules.denies(user) {
+		return false
+	}
+
+	if !whitelisted && (instanceRules == nil || !instanceRules.allows(user)) {
+		return false
+	}
+
+	if actionRules != nil && actionRules.HasAllowRules() && !actionRules.allows(user) {
+		return false
+	}
+
+	return true
+}
+
+func containsString(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
+		}
+	}
+
+	return false
+}
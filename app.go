@@ -4,161 +4,542 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
+	"runtime/debug"
 	"sync"
 	"time"
 )
 
+var (
+	ErrAppPanicked = errors.New("App panicked")
+)
+
 // Instance represents a currently loaded and running app
 type Instance struct {
 	sync.RWMutex
 
 	// Immutable fields
 	// Do nott modify these or you will encounter race conditions
-	Session   *discordgo.Session
+	ID        string // Unique, stays the same when saved and restored
+	Session   Session
 	Engine    *Engine
 	App       App
 	ChannelID string
 	GuildID   string
-	Actions   []*Action
+	Actions   []*Action // Only change these through AddActions, RemoveActions and ClearActions, or they wont be found
+
+	// How the actions are shown, only change it through SetTransport once the app has started
+	Transport Transport
 
 	// Will only react to these users
 	UserIDs       []string
 	AllowAllUsers bool
 
+	// Further access rules by user, role and permission, see checkAccess for how these combine with the above
+	Access *AccessRules
+
 	IdleTimeout time.Duration
 	LastAction  time.Time
+
+	// If the app implements IdleWarner it will be warned this long before it times out
+	IdleWarning time.Duration
+	idleWarned  bool
+
+	exited bool
+
+	// Set when the instance has changed since it was last saved
+	dirty bool
+	// The state the instance was last saved with
+	saved *SerializedAppState
+
+	// Actions by message and emoji, rebuilt whenever the actions change through the methods below
+	actionsByKey map[string]*Action
+
+	// What the instance is currently indexed by in the engine, protected by the engine's lock
+	indexedUsers    []string
+	indexedMessages []string
+
+	// Reaction removals we caused ourselves and don't want to report to the app, by message:emoji:user
+	suppressedRemoves map[string]*suppressedRemove
+
+	// Events are delivered to the app one at a time, in order, through this queue
+	queue *eventQueue
 }
 
-func (i *Instance) handleReactionAdd(s *discordgo.Session, ra *discordgo.MessageReactionAdd) {
+func (i *Instance) handleReaction(userID, messageID string, emoji discordgo.Emoji, added bool) {
 	i.RLock()
+	action := i.actionsByKey[actionKey(messageID, EmojiFromDiscord(emoji).key())]
+	i.RUnlock()
 
-	if !i.AllowAllUsers {
-		// Check user filter
-		found := false
-		for _, v := range i.UserIDs {
-			if v == ra.UserID {
-				found = true
-				break
-			}
+	if action == nil {
+		return
+	}
+
+	i.useAction(userID, action, added, true)
+}
+
+// useAction checks if the user may use the action and passes it on to the app
+// isReaction is false if the action was used through a component, which can't be removed or toggled
+func (i *Instance) useAction(userID string, action *Action, added, isReaction bool) {
+	// Before checking access, the reactions we removed for not being allowed belong to users who fail it
+	if !added && i.consumeSuppressedRemove(action, userID) {
+		// We removed this reaction ourselves
+		return
+	}
+
+	toggleApp, isToggleApp := i.App.(ToggleApp)
+	if !added && !isToggleApp {
+		// Only toggle apps care about reactions being removed, no need to check access for it
+		return
+	}
+
+	i.RLock()
+	whitelisted := i.isWhitelisted(userID)
+	instanceRules := i.Access
+	i.RUnlock()
+
+	// Roles and permissions may have to be fetched, so don't hold the lock while checking
+	user := &accessUser{session: i.Session, guildID: i.GuildID, channelID: i.ChannelID, id: userID}
+	if !checkAccess(user, whitelisted, instanceRules, action.Access) {
+		if isReaction && added && action.RemoveReactionNotWhitelisted {
+			i.removeUserReaction(action, userID)
 		}
+		return
+	}
 
-		if !found {
-			i.RUnlock()
-			return
+	var handler ActionHandlerFunc
+	if added && action.Name != "" {
+		var ok bool
+		handler, ok = RegisteredActionHandlers[action.Name]
+		if !ok {
+			logrus.WithField("action", action.Name).Warn("Unknown action handler, falling back to HandleAction")
 		}
 	}
-	var action *Action
 
-	// Find the corresponding action
-	for _, a := range i.Actions {
-		if a.MessageID == ra.MessageID && a.Emoji == ra.Emoji.Name {
-			// Bingo!
-			action = a
-			break
+	// Upgrade the lock, and call the callback if found
+	err := i.callApp("action", func() error {
+		i.touch()
+		if handler != nil {
+			return handler(i, userID, action)
+		}
+
+		if isToggleApp {
+			return toggleApp.HandleActionToggle(userID, action, added)
+		}
+
+		return i.App.HandleAction(userID, action)
+	})
+
+	if err == nil && isReaction && added && action.RemoveReactionOnSuccess {
+		i.removeUserReaction(action, userID)
+	}
+
+	if err == nil && i.Engine.CheckpointAfterAction {
+		err = i.Engine.checkpointInstance(i)
+		if err != nil {
+			logrus.WithError(err).Error("Failed checkpointing apps")
 		}
 	}
+}
 
+// handleMessage passes a message sent in the channel to the app, if the user is allowed to use the instance
+func (i *Instance) handleMessage(msg *discordgo.Message) {
+	i.RLock()
+	whitelisted := i.isWhitelisted(msg.Author.ID)
+	instanceRules := i.Access
+	exited := i.exited
 	i.RUnlock()
 
-	if action == nil {
+	if exited {
 		return
 	}
 
-	// Upgrade the lock, and call the callback if found
+	user := &accessUser{session: i.Session, guildID: i.GuildID, channelID: i.ChannelID, id: msg.Author.ID}
+	if !checkAccess(user, whitelisted, instanceRules, nil) {
+		return
+	}
+
+	consumed := false
+	err := i.callApp("message", func() error {
+		var err error
+		consumed, err = i.App.(MessageApp).HandleMessage(msg.Author.ID, msg)
+		if consumed {
+			i.touch()
+		}
+		return err
+	})
+
+	if err != nil || !consumed {
+		return
+	}
+
+	err = i.Session.ChannelMessageDelete(msg.ChannelID, msg.ID)
+	if err != nil {
+		logrus.WithError(err).Error("Failed deleting consumed message")
+	}
+
+	if i.Engine.CheckpointAfterAction {
+		err = i.Engine.checkpointInstance(i)
+		if err != nil {
+			logrus.WithError(err).Error("Failed checkpointing apps")
+		}
+	}
+}
+
+// handleMessagesDeleted drops the actions on the deleted messages, and exits the instance unless the app wants to keep running
+func (i *Instance) handleMessagesDeleted(messageIDs []string) {
 	i.Lock()
-	err := i.App.HandleAction(ra.UserID, action)
+	if i.exited {
+		i.Unlock()
+		return
+	}
+
+	// The reactions are gone along with the messages, so there's nothing to clean up on discord
+	kept := make([]*Action, 0, len(i.Actions))
+	for _, a := range i.Actions {
+		if !containsString(messageIDs, a.MessageID) {
+			kept = append(kept, a)
+		}
+	}
+
+	if len(kept) == len(i.Actions) {
+		// Already dropped
+		i.Unlock()
+		return
+	}
+
+	i.Actions = kept
+	i.dirty = true
+	i.actionsChanged()
 	i.Unlock()
 
+	keepRunning := false
+	if handler, ok := i.App.(MessageDeleteHandler); ok {
+		err := i.callApp("messages deleted", func() error {
+			var err error
+			keepRunning, err = handler.HandleMessagesDeleted(messageIDs)
+			return err
+		})
+
+		if err == ErrAppPanicked {
+			return
+		}
+	}
+
+	if !keepRunning {
+		i.Lock()
+		i.Exit(ExitMessageDeleted)
+		i.Unlock()
+	}
+}
+
+// isWhitelisted returns true if the user is allowed to use this instance's actions, the instance has to be read locked
+func (i *Instance) isWhitelisted(userID string) bool {
+	if i.AllowAllUsers {
+		return true
+	}
+
+	for _, v := range i.UserIDs {
+		if v == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// How long the remove event of a reaction we removed is waited for
+// It never comes if HandleMessageReactionRemove isn't added as a handler, and after this a removal is the user's own again
+const suppressedRemoveExpiry = time.Second * 10
+
+type suppressedRemove struct {
+	count int
+	// When the last one was removed
+	at time.Time
+}
+
+// removeUserReaction removes a user's reaction on the action, without reporting the removal to the app
+func (i *Instance) removeUserReaction(action *Action, userID string) {
+	key := suppressedRemoveKey(action, userID)
+	now := i.Engine.Now()
+
+	i.Lock()
+	i.expireSuppressedRemoves(now)
+	if i.suppressedRemoves == nil {
+		i.suppressedRemoves = make(map[string]*suppressedRemove)
+	}
+
+	suppressed := i.suppressedRemoves[key]
+	if suppressed == nil {
+		suppressed = &suppressedRemove{}
+		i.suppressedRemoves[key] = suppressed
+	}
+	suppressed.count++
+	suppressed.at = now
+	i.Unlock()
+
+	err := i.Session.MessageReactionRemove(i.ChannelID, action.MessageID, action.Emoji.APIName(), userID)
 	if err != nil {
-		logrus.WithError(err).Error("Error running action callback")
+		// No remove event will be coming
+		i.Lock()
+		i.releaseSuppressedRemove(key)
+		i.Unlock()
+
+		logrus.WithError(err).Error("Failed removing reaction")
+	}
+}
+
+// consumeSuppressedRemove returns true if the removal of the users reaction was caused by removeUserReaction
+func (i *Instance) consumeSuppressedRemove(action *Action, userID string) bool {
+	key := suppressedRemoveKey(action, userID)
+	now := i.Engine.Now()
+
+	i.Lock()
+	defer i.Unlock()
+
+	i.expireSuppressedRemoves(now)
+	if i.suppressedRemoves[key] == nil {
+		return false
+	}
+
+	i.releaseSuppressedRemove(key)
+	return true
+}
+
+func (i *Instance) releaseSuppressedRemove(key string) {
+	suppressed := i.suppressedRemoves[key]
+	if suppressed == nil {
+		return
 	}
+
+	suppressed.count--
+	if suppressed.count < 1 {
+		delete(i.suppressedRemoves, key)
+	}
+}
+
+// expireSuppressedRemoves forgets the removals whose events didn't arrive in time, the instance has to be locked
+func (i *Instance) expireSuppressedRemoves(now time.Time) {
+	for k, v := range i.suppressedRemoves {
+		if now.Sub(v.at) > suppressedRemoveExpiry {
+			delete(i.suppressedRemoves, k)
+		}
+	}
+}
+
+func suppressedRemoveKey(action *Action, userID string) string {
+	return actionKey(action.MessageID, action.Emoji.key()) + ":" + userID
+}
+
+// actionKey identifies a action by its message and the key of its emoji
+func actionKey(messageID, emojiKey string) string {
+	return messageID + ":" + emojiKey
+}
+
+// actionsChanged updates the action lookup and the engine's index after the actions changed, the instance has to be locked
+func (i *Instance) actionsChanged() {
+	i.indexActions()
+	i.reindex()
 }
 
-// AddActions registers a set of of actions on the message, adding the reactions aswell
+func (i *Instance) indexActions() {
+	i.actionsByKey = make(map[string]*Action, len(i.Actions))
+	for _, a := range i.Actions {
+		key := actionKey(a.MessageID, a.Emoji.key())
+		// The first one added wins, as it did when searching the list
+		if _, ok := i.actionsByKey[key]; !ok {
+			i.actionsByKey[key] = a
+		}
+	}
+}
+
+// callApp runs fn with the instance locked, logging errors and exiting the app with ExitError if it panics
+// Returns the error fn returned, or ErrAppPanicked
+func (i *Instance) callApp(callback string, fn func() error) (err error) {
+	panicked := false
+
+	func() {
+		i.Lock()
+		defer i.Unlock()
+
+		defer func() {
+			if r := recover(); r != nil {
+				logrus.WithField("panic", r).WithField("callback", callback).Error("App panicked\n" + string(debug.Stack()))
+				panicked = true
+			}
+		}()
+
+		err = fn()
+
+		// The app may have changed its state even if it errored
+		i.dirty = true
+
+		if err != nil {
+			logrus.WithError(err).WithField("callback", callback).Error("Error running app callback")
+		}
+	}()
+
+	if panicked {
+		i.Lock()
+		i.Exit(ExitError)
+		i.Unlock()
+		return ErrAppPanicked
+	}
+
+	return err
+}
+
+// MarkDirty marks the instance as changed so it's saved on the next checkpoint
+// This is done automatically after callbacks and when using the methods on Instance,
+// so it's only needed if the app changes its state from elsewhere
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
-func (i *Instance) AddActions(actions ...*Action) error {
-	i.Actions = append(i.Actions, actions...)
+func (i *Instance) MarkDirty() {
+	i.dirty = true
+}
 
-	// Add the reactions
-	for _, v := range actions {
-		err := i.Session.MessageReactionAdd(i.ChannelID, v.MessageID, v.Emoji)
+// touch resets the idle timer, the instance has to be locked
+func (i *Instance) touch() {
+	i.LastAction = i.Engine.Now()
+	i.idleWarned = false
+}
+
+// warnIdle calls the app's IdleWarner hook, resetting the idle timer if it asks to
+func (i *Instance) warnIdle() {
+	i.callApp("idle warning", func() error {
+		if i.idleWarned || i.exited {
+			return nil
+		}
+		i.idleWarned = true
+
+		remaining := i.IdleTimeout - i.Engine.Now().Sub(i.LastAction)
+		extend, err := i.App.(IdleWarner).HandleIdleWarning(remaining)
+		if extend {
+			i.touch()
+		}
+
+		return err
+	})
+}
+
+// AddActions registers a set of of actions on the message, adding the reactions (or components) aswell
+// Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
+func (i *Instance) AddActions(actions ...*Action) error {
+	if i.Transport != TransportReactions {
+		err := validateComponentActions(append(append([]*Action(nil), i.Actions...), actions...))
 		if err != nil {
 			return errors.WithMessage(err, "AddActions")
 		}
 	}
 
-	return nil
+	i.Actions = append(i.Actions, actions...)
+	i.dirty = true
+	i.actionsChanged()
+
+	return errors.WithMessage(i.showActions(actions), "AddActions")
 }
 
 // RemoveActions unregisters a set of of actions on the message, clearing the reactions aswell
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
 func (inst *Instance) RemoveActions(actions ...*Action) {
-	for i := 0; i < len(inst.Actions); i++ {
+	inst.dirty = true
+
+	var kept, removed []*Action
+	for _, elem := range inst.Actions {
+		found := false
 		for _, a := range actions {
-			elem := inst.Actions[i]
-			if elem != a {
-				continue
+			if elem == a {
+				found = true
+				break
 			}
+		}
 
-			inst.Actions = append(inst.Actions[:i], inst.Actions[i+1:]...)
-
-			// Remove the reactions
-			// TODO: Remove all users reactions
-			inst.Session.MessageReactionRemove(inst.ChannelID, elem.MessageID, elem.Emoji, "@me")
+		if found {
+			removed = append(removed, elem)
+		} else {
+			kept = append(kept, elem)
 		}
 	}
+	inst.Actions = kept
+
+	inst.actionsChanged()
+	inst.hideActions(removed, false)
 }
 
 // ClearActions unregisters all actions on the message, clearing the reactions aswell
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
 func (i *Instance) ClearActions() {
-	for _, a := range i.Actions {
-		// Remove the reactions
-		i.Session.MessageReactionsRemoveAll(i.ChannelID, a.MessageID)
-	}
+	removed := i.Actions
 
-	i.Actions = nil // Maybe also remove the reactions?
+	i.Actions = nil
+	i.dirty = true
+	i.actionsChanged()
+	i.hideActions(removed, true)
 }
 
 // AddUsers adds the specified users to the whitelist
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
 func (i *Instance) AddUsers(UserIDs []string) {
 	i.UserIDs = append(i.UserIDs, UserIDs...)
+	i.dirty = true
+	i.reindex()
 }
 
 // RemoveUsers removes the specified users from the whitelist
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
 func (i *Instance) RemoveUsers(UserIDs []string) {
-	for j := 0; j < len(i.Actions); j++ {
-		for _, uid := range UserIDs {
-			elem := i.UserIDs[j]
-			if elem == uid {
-				i.UserIDs = append(i.UserIDs[:j], i.UserIDs[j+1:]...)
-			}
+	i.dirty = true
+
+	kept := i.UserIDs[:0]
+	for _, v := range i.UserIDs {
+		if !containsString(UserIDs, v) {
+			kept = append(kept, v)
 		}
 	}
+	i.UserIDs = kept
+
+	i.reindex()
 }
 
 // ClearUsers clears the whitelist
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
 func (i *Instance) ClearUsers() {
 	i.UserIDs = nil
+	i.dirty = true
+	i.reindex()
 }
 
-// Exit ends a App.
+// Exit ends a App, reason is passed on to App.Exit
 // Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
-func (inst *Instance) Exit() {
+func (inst *Instance) Exit(reason ExitReason) {
+	if inst.exited {
+		return
+	}
+	inst.exited = true
+
 	inst.Engine.Lock()
+	inst.Engine.removeInstance(inst)
+	inst.Engine.Unlock()
 
-	for i, v := range inst.Engine.CurrentInstances {
-		if v == inst {
-			inst.Engine.CurrentInstances = append(inst.Engine.CurrentInstances[:i], inst.Engine.CurrentInstances[i+1:]...)
-		}
+	// Don't wait for the worker here, we may be called from inside a event
+	if inst.queue != nil {
+		inst.queue.close()
 	}
 
-	inst.Engine.Unlock()
+	// In the background since it has to wait for checkpoints, which may be waiting for this instance's lock
+	go inst.Engine.deleteInstance(inst.ID)
+
+	err := inst.App.Exit(inst, reason)
+	if err != nil {
+		logrus.WithError(err).WithField("reason", reason.String()).Error("Error exiting app")
+	}
+}
+
+// QueueStats returns statistics about this instance's event queue
+func (i *Instance) QueueStats() QueueStats {
+	if i.queue == nil {
+		return QueueStats{}
+	}
 
-	inst.App.Exit(inst)
+	return i.queue.stats()
 }
 
 type App interface {
@@ -166,8 +547,8 @@ type App interface {
 	// This is not called when loading from a serialized state
 	Start(instance *Instance) error
 
-	// Perform cleanup here
-	Exit(instance *Instance) error
+	// Perform cleanup here, reason tells why the app is exiting
+	Exit(instance *Instance, reason ExitReason) error
 
 	HandleAction(userID string, action *Action) error
 
@@ -177,3 +558,76 @@ type App interface {
 	// Initalize the app here from a serialized state
 	LoadState(*Instance, []byte) error
 }
+
+// ExitReason describes why a app is exiting
+type ExitReason int
+
+const (
+	// The app finished on its own, e.g. a game was won
+	ExitCompleted ExitReason = iota
+	// Nothing happened within the instance's IdleTimeout
+	ExitTimeout
+	// The app was stopped from outside of the app
+	ExitCancelled
+	// The engine is shutting down and the app could not be saved
+	ExitShutdown
+	// The channel the app was running in was deleted or is no longer available
+	ExitChannelGone
+	// The app panicked
+	ExitError
+	// A message the app had actions on was deleted
+	ExitMessageDeleted
+)
+
+func (r ExitReason) String() string {
+	switch r {
+	case ExitCompleted:
+		return "Completed"
+	case ExitTimeout:
+		return "Timeout"
+	case ExitCancelled:
+		return "Cancelled"
+	case ExitShutdown:
+		return "Shutdown"
+	case ExitChannelGone:
+		return "ChannelGone"
+	case ExitError:
+		return "Error"
+	case ExitMessageDeleted:
+		return "MessageDeleted"
+	}
+
+	return "Unknown"
+}
+
+// ToggleApp is an optional interface apps can implement to also be notified when reactions are removed,
+// allowing for toggle style actions such as "react to join, unreact to leave"
+type ToggleApp interface {
+	App
+
+	// Called instead of HandleAction, added is false if the user removed their reaction
+	// Removals are reported here even for actions bound to a named action handler
+	HandleActionToggle(userID string, action *Action, added bool) error
+}
+
+// MessageApp is an optional interface apps can implement to receive the messages users send in the instance's channel
+// Only messages from users allowed to use the instance are passed on, the same as with reactions
+// The session needs the privileged IntentsMessageContent (also enabled for the bot in the developer portal),
+// otherwise discord sends the messages with an empty Content
+type MessageApp interface {
+	// Return true if the message was meant for the app, it's then deleted and resets the idle timer
+	HandleMessage(userID string, msg *discordgo.Message) (consume bool, err error)
+}
+
+// MessageDeleteHandler is an optional interface apps can implement to keep running when messages they have actions on are deleted
+// Apps not implementing it are exited with ExitMessageDeleted
+type MessageDeleteHandler interface {
+	// The actions on the messages have already been removed, return false to exit with ExitMessageDeleted
+	HandleMessagesDeleted(messageIDs []string) (keepRunning bool, err error)
+}
+
+// IdleWarner is an optional interface apps can implement to be warned Instance.IdleWarning before they time out
+type IdleWarner interface {
+	// Return true to reset the idle timer, or false to let the app time out
+	HandleIdleWarning(remaining time.Duration) (extend bool, err error)
+}
@@ -0,0 +1,181 @@
+package drai
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// AppState implements SerializeState and LoadState for the app embedding it, T being the app's own type:
+//
+//	type Game struct {
+//		drai.AppState[Game]
+//		Instance *drai.Instance `json:"-"`
+//		...
+//	}
+//
+// The app's exported fields are saved as json, after loading all *Instance fields in the app (and in structs it points to,
+// such as a UserFinder) are set to the instance, then AfterLoad is called if the app implements AfterLoader
+// RegisterApp panics if the app has fields that can't be saved, use `json:"-"` on those
+type AppState[T any] struct {
+	app *T
+}
+
+// AfterLoader can be implemented by apps using AppState to rewire things that can't be saved, such as callbacks
+type AfterLoader interface {
+	AfterLoad(instance *Instance) error
+}
+
+// appBinder is implemented by AppState, the engine binds the app to it before calling Start or LoadState
+type appBinder interface {
+	bindApp(app App) error
+	validateApp(app App) error
+}
+
+func (s *AppState[T]) bindApp(app App) error {
+	typed, ok := interface{}(app).(*T)
+	if !ok {
+		return errors.New("AppState type parameter does not match the app embedding it")
+	}
+
+	s.app = typed
+	return nil
+}
+
+func (s *AppState[T]) validateApp(app App) error {
+	if _, ok := interface{}(app).(*T); !ok {
+		return errors.New("AppState type parameter does not match the app embedding it")
+	}
+
+	return validateSerializable(reflect.TypeOf(app).Elem(), reflect.TypeOf(app).Elem().Name(), make(map[reflect.Type]bool))
+}
+
+func (s *AppState[T]) SerializeState() ([]byte, error) {
+	if s.app == nil {
+		return nil, errors.New("AppState not bound to a app")
+	}
+
+	return json.Marshal(s.app)
+}
+
+func (s *AppState[T]) LoadState(instance *Instance, data []byte) error {
+	if s.app == nil {
+		return errors.New("AppState not bound to a app")
+	}
+
+	err := json.Unmarshal(data, s.app)
+	if err != nil {
+		return err
+	}
+
+	setInstanceFields(reflect.ValueOf(s.app), instance, make(map[uintptr]bool))
+
+	if loader, ok := interface{}(s.app).(AfterLoader); ok {
+		return loader.AfterLoad(instance)
+	}
+
+	return nil
+}
+
+// bindApp binds the app to its AppState, if it's using one
+func bindApp(app App) error {
+	if binder, ok := app.(appBinder); ok {
+		return binder.bindApp(app)
+	}
+
+	return nil
+}
+
+var (
+	instancePtrType     = reflect.TypeOf((*Instance)(nil))
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// setInstanceFields sets all exported *Instance fields reachable from v through structs, pointers and slices
+func setInstanceFields(v reflect.Value, instance *Instance, seen map[uintptr]bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || v.Type() == instancePtrType || seen[v.Pointer()] {
+			return
+		}
+		seen[v.Pointer()] = true
+
+		setInstanceFields(v.Elem(), instance, seen)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+
+			if field.Type() == instancePtrType {
+				field.Set(reflect.ValueOf(instance))
+				continue
+			}
+
+			setInstanceFields(field, instance, seen)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			setInstanceFields(v.Index(i), instance, seen)
+		}
+	}
+}
+
+// validateSerializable returns a error if t has exported fields that can't be saved as json
+func validateSerializable(t reflect.Type, path string, seen map[reflect.Type]bool) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	// Handles its own encoding
+	if t.Implements(jsonMarshalerType) && reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return errors.New(path + " of type " + t.String() + " can't be saved, add `json:\"-\"` to skip it")
+	case reflect.Interface:
+		if t.NumMethod() > 0 {
+			return errors.New(path + " of interface type " + t.String() + " can't be loaded, add `json:\"-\"` to skip it")
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return validateSerializable(t.Elem(), path, seen)
+	case reflect.Map:
+		key := t.Key()
+		switch key.Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			if !key.Implements(textMarshalerType) {
+				return errors.New(path + " has map key type " + key.String() + " which can't be saved")
+			}
+		}
+
+		return validateSerializable(t.Elem(), path, seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" && !field.Anonymous {
+				// Unexported
+				continue
+			}
+
+			if field.Tag.Get("json") == "-" {
+				continue
+			}
+
+			err := validateSerializable(field.Type, path+"."+field.Name, seen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
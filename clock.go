@@ -0,0 +1,122 @@
+package drai
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the time to the engine, replace Engine.Clock with a ManualClock to control time in tests
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker used by the engine
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r *realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r *realTicker) Stop() {
+	r.t.Stop()
+}
+
+// ManualClock is a Clock that only moves forward when Advance is called
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+var _ Clock = (*ManualClock)(nil)
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now: now,
+	}
+}
+
+func (m *ManualClock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *ManualClock) NewTicker(d time.Duration) Ticker {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := &manualTicker{
+		clock:    m,
+		interval: d,
+		next:     m.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	m.tickers = append(m.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing any tickers that are due
+// Like time.Ticker, ticks are dropped if the receiver has not kept up
+func (m *ManualClock) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.now = m.now.Add(d)
+
+	for _, t := range m.tickers {
+		if t.next.After(m.now) {
+			continue
+		}
+
+		for !t.next.After(m.now) {
+			t.next = t.next.Add(t.interval)
+		}
+
+		select {
+		case t.c <- m.now:
+		default:
+		}
+	}
+}
+
+type manualTicker struct {
+	clock    *ManualClock
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, v := range t.clock.tickers {
+		if v == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			break
+		}
+	}
+}
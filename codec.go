@@ -0,0 +1,241 @@
+package drai
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Codec encodes the application states persisted by storage backends
+type Codec interface {
+	// Name identifies the codec in the header of persisted data, so it can be decoded again with the same codec
+	Name() string
+
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	RegisteredCodecs   = make(map[string]Codec)
+	registeredCodecsMU sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(GobCodec{})
+	RegisterCodec(MsgpackCodec{})
+}
+
+// RegisterCodec registers a codec so data encoded with it can be decoded
+// Compressed variants of registered codecs are available without registering them, e.g "gzip+json"
+func RegisterCodec(c Codec) {
+	registeredCodecsMU.Lock()
+	RegisteredCodecs[c.Name()] = c
+	registeredCodecsMU.Unlock()
+}
+
+// CodecByName returns the registered codec with the name, including the compressed variants
+func CodecByName(name string) (Codec, bool) {
+	registeredCodecsMU.RLock()
+	c, ok := RegisteredCodecs[name]
+	registeredCodecsMU.RUnlock()
+	if ok {
+		return c, true
+	}
+
+	if inner := strings.TrimPrefix(name, "gzip+"); inner != name {
+		c, ok := CodecByName(inner)
+		if ok {
+			return GzipCodec{Codec: c}, true
+		}
+	}
+
+	if inner := strings.TrimPrefix(name, "zstd+"); inner != name {
+		c, ok := CodecByName(inner)
+		if ok {
+			return ZstdCodec{Codec: c}, true
+		}
+	}
+
+	return nil, false
+}
+
+// JSONCodec is the default codec
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes using encoding/gob
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// MsgpackCodec encodes using msgpack, struct fields are named after their json tags
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (MsgpackCodec) Decode(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// GzipCodec compresses the output of another codec with gzip
+type GzipCodec struct {
+	Codec Codec
+}
+
+func (g GzipCodec) Name() string {
+	return "gzip+" + g.Codec.Name()
+}
+
+func (g GzipCodec) Encode(v interface{}) ([]byte, error) {
+	encoded, err := g.Codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+func (g GzipCodec) Decode(data []byte, v interface{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return g.Codec.Decode(decompressed, v)
+}
+
+// ZstdCodec compresses the output of another codec with zstd
+type ZstdCodec struct {
+	Codec Codec
+}
+
+func (z ZstdCodec) Name() string {
+	return "zstd+" + z.Codec.Name()
+}
+
+func (z ZstdCodec) Encode(v interface{}) ([]byte, error) {
+	encoded, err := z.Codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	return w.EncodeAll(encoded, nil), nil
+}
+
+func (z ZstdCodec) Decode(data []byte, v interface{}) error {
+	r, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	decompressed, err := r.DecodeAll(data, nil)
+	if err != nil {
+		return err
+	}
+
+	return z.Codec.Decode(decompressed, v)
+}
+
+// codecHeader starts all data encoded by EncodeWithHeader, followed by the codec name and a newline
+const codecHeader = "DRAI1 "
+
+// EncodeWithHeader encodes v with the codec, prefixed by a header naming the codec
+// Storage backends should use it so the data can be decoded regardless of the codec configured when loading
+func EncodeWithHeader(c Codec, v interface{}) ([]byte, error) {
+	encoded, err := c.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(codecHeader)+len(c.Name())+1+len(encoded))
+	out = append(out, codecHeader...)
+	out = append(out, c.Name()...)
+	out = append(out, '\n')
+	return append(out, encoded...), nil
+}
+
+// DecodeWithHeader decodes data encoded by EncodeWithHeader using the codec named in the header
+// Data without a header is from before codecs and decoded as json
+func DecodeWithHeader(data []byte, v interface{}) error {
+	if !bytes.HasPrefix(data, []byte(codecHeader)) {
+		return json.Unmarshal(data, v)
+	}
+
+	data = data[len(codecHeader):]
+	nl := bytes.IndexByte(data, '\n')
+	if nl == -1 {
+		return errors.New("Invalid codec header")
+	}
+
+	name := string(data[:nl])
+	c, ok := CodecByName(name)
+	if !ok {
+		return errors.New("Unknown codec: " + name)
+	}
+
+	return c.Decode(data[nl+1:], v)
+}
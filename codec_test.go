@@ -0,0 +1,150 @@
+package drai
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func codecTestStates() []*SerializedAppState {
+	nested := UserData{}
+	nested.Set("x", int64(2))
+
+	ud := UserData{}
+	ud.Set("index", 3)
+	ud.Set("name", "knight")
+	ud.Set("nested", nested)
+
+	return []*SerializedAppState{
+		{
+			ID:         "1",
+			AppID:      "test",
+			AppVersion: 2,
+			ChannelID:  "c",
+			GuildID:    "g",
+			Actions: []*Action{
+				{UserData: ud, Emoji: UnicodeEmoji("👍"), MessageID: "m1", Name: "move", Label: "Up"},
+				{Emoji: CustomEmoji("blob", "123", true), MessageID: "m2", Access: &AccessRules{DenyUsers: []string{"d"}}},
+			},
+			AppData:     json.RawMessage(`{"count":1}`),
+			Users:       []string{"u1", "u2"},
+			Access:      &AccessRules{AllowRoles: []string{"r"}},
+			Transport:   TransportButtons,
+			IdleTimeout: time.Minute,
+			LastAction:  time.Unix(1000, 5).UTC(),
+		},
+		{
+			ID:            "2",
+			AppID:         "test",
+			ChannelID:     "c",
+			AllowAllUsers: true,
+			AppData:       json.RawMessage(`{}`),
+		},
+	}
+}
+
+// codecNames returns the names of all codecs CodecByName knows about
+func codecNames() []string {
+	registeredCodecsMU.RLock()
+	defer registeredCodecsMU.RUnlock()
+
+	var names []string
+	for name := range RegisteredCodecs {
+		names = append(names, name, "gzip+"+name, "zstd+"+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func expectCodecTestStates(t *testing.T, decoded []*SerializedAppState) {
+	t.Helper()
+
+	expected := codecTestStates()
+	if len(decoded) != len(expected) {
+		t.Fatal("Expected", len(expected), "states, got", len(decoded))
+	}
+
+	for i, v := range decoded {
+		// msgpack decodes times in the local time zone
+		if !v.LastAction.Equal(expected[i].LastAction) {
+			t.Fatal("LastAction changed:", v.LastAction)
+		}
+		v.LastAction = expected[i].LastAction
+
+		if !reflect.DeepEqual(v, expected[i]) {
+			t.Fatalf("State changed:\n%#v\n%#v", v, expected[i])
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range codecNames() {
+		t.Run(name, func(t *testing.T) {
+			c, ok := CodecByName(name)
+			if !ok {
+				t.Fatal("CodecByName didn't find", name)
+			}
+
+			if c.Name() != name {
+				t.Fatal("Codec found by name has another name:", c.Name())
+			}
+
+			encoded, err := EncodeWithHeader(c, codecTestStates())
+			if err != nil {
+				t.Fatal("EncodeWithHeader:", err)
+			}
+
+			var decoded []*SerializedAppState
+			err = DecodeWithHeader(encoded, &decoded)
+			if err != nil {
+				t.Fatal("DecodeWithHeader:", err)
+			}
+
+			expectCodecTestStates(t, decoded)
+
+			index, _ := decoded[0].Actions[0].Int("index")
+			nested, _ := decoded[0].Actions[0].Nested("nested")
+			x, _ := nested.Get("x")
+			if index != 3 || x != int64(2) {
+				t.Error("User data lost its types:", index, x)
+			}
+		})
+	}
+}
+
+func TestDecodeWithHeaderLegacyJSON(t *testing.T) {
+	// Saved before codecs, plain json without a header
+	encoded, err := json.Marshal(codecTestStates())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []*SerializedAppState
+	err = DecodeWithHeader(encoded, &decoded)
+	if err != nil {
+		t.Fatal("DecodeWithHeader:", err)
+	}
+
+	expectCodecTestStates(t, decoded)
+}
+
+func TestDecodeWithHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unknown codec", codecHeader + "nope\n{}"},
+		{"unknown compressed codec", codecHeader + "gzip+nope\n{}"},
+		{"no newline", codecHeader + "json"},
+	}
+
+	for _, tc := range tests {
+		var decoded []*SerializedAppState
+		err := DecodeWithHeader([]byte(tc.data), &decoded)
+		if err == nil {
+			t.Errorf("%s: expected a error", tc.name)
+		}
+	}
+}
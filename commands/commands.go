@@ -0,0 +1,274 @@
+// Package commands starts registered drai apps through discord application (slash) commands
+//
+// Apps opt in by implementing App, then a System registers a command for each of them
+// and starts a new instance of the app whenever its command is used
+package commands
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/jonas747/drai"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// App is implemented by registered apps that can be started through a application command
+// Both methods are called on a zero value of the app's registered type, not on a running app
+type App interface {
+	drai.App
+
+	// Command returns the name, description and options of the command starting the app
+	Command() *discordgo.ApplicationCommand
+
+	// NewFromCommand creates the app to start for a use of the command
+	// The error message is shown to the user who used the command, so keep it friendly
+	NewFromCommand(inv *Invocation) (drai.App, error)
+}
+
+// Session is the part of the discord api used by the System
+// *discordgo.Session and *drai.FakeSession implement it
+type Session interface {
+	drai.Session
+
+	ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+}
+
+var (
+	_ Session = (*discordgo.Session)(nil)
+	_ Session = (*drai.FakeSession)(nil)
+)
+
+var (
+	ErrDuplicateCommand = errors.New("Two apps use the same command name")
+)
+
+// System registers the commands of the apps and starts them when used
+type System struct {
+	Engine *drai.Engine
+
+	// Passed to Engine.StartApp for apps started through a command
+	IdleTimeout time.Duration
+
+	mu sync.RWMutex
+	// command name -> registered app id
+	apps map[string]string
+}
+
+// New returns a System starting apps on the engine
+func New(engine *drai.Engine) *System {
+	return &System{
+		Engine:      engine,
+		IdleTimeout: time.Minute,
+	}
+}
+
+// Register registers a command for every registered app implementing App, in the guild or globally if guildID is empty
+// Note: This overwrites all other commands the bot has in that scope
+func (s *System) Register(session Session, applicationID, guildID string) error {
+	ids := make([]string, 0, len(drai.RegisteredApps))
+	for id := range drai.RegisteredApps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	apps := make(map[string]string)
+	cmds := make([]*discordgo.ApplicationCommand, 0, len(ids))
+	for _, id := range ids {
+		app, ok := commandApp(id)
+		if !ok {
+			continue
+		}
+
+		cmd := app.Command()
+		if _, ok := apps[cmd.Name]; ok {
+			return ErrDuplicateCommand
+		}
+
+		if cmd.DMPermission == nil {
+			// Apps run in guild channels
+			dm := false
+			cmd.DMPermission = &dm
+		}
+
+		apps[cmd.Name] = id
+		cmds = append(cmds, cmd)
+	}
+
+	_, err := session.ApplicationCommandBulkOverwrite(applicationID, guildID, cmds)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.apps = apps
+	s.mu.Unlock()
+
+	return nil
+}
+
+// commandApp returns a zero value of the registered app if it implements App
+func commandApp(id string) (App, bool) {
+	t, ok := drai.RegisteredApps[id]
+	if !ok {
+		return nil, false
+	}
+
+	app, ok := reflect.New(t).Interface().(App)
+	return app, ok
+}
+
+// HandleInteractionCreate is supposed to be added as a discord handler
+func (s *System) HandleInteractionCreate(ds *discordgo.Session, ic *discordgo.InteractionCreate) {
+	s.HandleInteraction(ds, ic.Interaction)
+}
+
+// HandleInteraction starts the app if the interaction is the use of one of the registered commands, other interactions are ignored
+func (s *System) HandleInteraction(session Session, interaction *discordgo.Interaction) {
+	if interaction.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	data := interaction.ApplicationCommandData()
+
+	s.mu.RLock()
+	appID, ok := s.apps[data.Name]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	// Has to be acknowledged within 3 seconds, starting the app may take longer than that
+	err := session.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed acknowledging command")
+		return
+	}
+
+	reply := s.start(session, appID, interaction, data)
+	_, err = session.InteractionResponseEdit(interaction, &discordgo.WebhookEdit{
+		Content: &reply,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed responding to command")
+	}
+}
+
+// start starts the app and returns the reply to the user
+func (s *System) start(session Session, appID string, interaction *discordgo.Interaction, data discordgo.ApplicationCommandInteractionData) string {
+	template, ok := commandApp(appID)
+	if !ok {
+		return "Unknown app"
+	}
+
+	inv := newInvocation(session, interaction, data)
+	app, err := template.NewFromCommand(inv)
+	if err != nil {
+		return err.Error()
+	}
+
+	inst, err := s.Engine.StartApp(session, app, interaction.GuildID, interaction.ChannelID, s.IdleTimeout)
+	if err != nil {
+		logrus.WithError(err).WithField("app", appID).Error("Failed starting app from command")
+		return "Failed starting :("
+	}
+
+	return "Started #" + inst.ID
+}
+
+// Invocation is a use of a app's command
+type Invocation struct {
+	Session     Session
+	Interaction *discordgo.Interaction
+
+	GuildID   string
+	ChannelID string
+
+	// The user who used the command
+	Author *discordgo.User
+
+	// The options given, by name
+	Options map[string]*discordgo.ApplicationCommandInteractionDataOption
+
+	resolved *discordgo.ApplicationCommandInteractionDataResolved
+}
+
+func newInvocation(session Session, interaction *discordgo.Interaction, data discordgo.ApplicationCommandInteractionData) *Invocation {
+	inv := &Invocation{
+		Session:     session,
+		Interaction: interaction,
+		GuildID:     interaction.GuildID,
+		ChannelID:   interaction.ChannelID,
+		Options:     make(map[string]*discordgo.ApplicationCommandInteractionDataOption),
+		resolved:    data.Resolved,
+	}
+
+	if interaction.Member != nil && interaction.Member.User != nil {
+		inv.Author = interaction.Member.User
+	} else {
+		inv.Author = interaction.User
+	}
+
+	for _, v := range data.Options {
+		inv.Options[v.Name] = v
+	}
+
+	return inv
+}
+
+// String returns the value of the string option, or "" if it was not given
+func (inv *Invocation) String(name string) string {
+	if o := inv.Options[name]; o != nil && o.Type == discordgo.ApplicationCommandOptionString {
+		return o.StringValue()
+	}
+
+	return ""
+}
+
+// Int returns the value of the integer option, or 0 if it was not given
+func (inv *Invocation) Int(name string) int64 {
+	if o := inv.Options[name]; o != nil && o.Type == discordgo.ApplicationCommandOptionInteger {
+		return o.IntValue()
+	}
+
+	return 0
+}
+
+// Bool returns the value of the boolean option, or false if it was not given
+func (inv *Invocation) Bool(name string) bool {
+	if o := inv.Options[name]; o != nil && o.Type == discordgo.ApplicationCommandOptionBoolean {
+		return o.BoolValue()
+	}
+
+	return false
+}
+
+// User returns the user given as the user option, or nil if it was not given
+func (inv *Invocation) User(name string) *discordgo.User {
+	o := inv.Options[name]
+	if o == nil || o.Type != discordgo.ApplicationCommandOptionUser {
+		return nil
+	}
+
+	id, _ := o.Value.(string)
+	if id == "" {
+		return nil
+	}
+
+	if inv.resolved != nil {
+		if u, ok := inv.resolved.Users[id]; ok {
+			return u
+		}
+	}
+
+	// Not resolved by discord, at least the id is known
+	return &discordgo.User{ID: id}
+}
@@ -1,6 +1,9 @@
 package drai
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
@@ -12,166 +15,725 @@ var (
 	ErrStopping = errors.New("Engine is stopping")
 )
 
+const DefaultSweepInterval = time.Second * 10
+
 type Engine struct {
 	sync.RWMutex
 
 	// Currently running and active application instances
 	CurrentInstances []*Instance
 
+	// CurrentInstances indexed for the Find methods
+	index instanceIndex
+
 	StorageBackend StorageBackend
 
+	// Size of each instance's event queue, defaults to DefaultQueueSize
+	// Note: discordgo only calls handlers in the order events arrived if SyncEvents is enabled on the session
+	QueueSize int
+	// What to do with incoming events when a instance's queue is full, defaults to QueuePolicyBlock
+	// With SyncEvents that stalls all discord event handling while any queue is full, consider QueuePolicyDropNewest
+	QueuePolicy QueuePolicy
+
+	// How often Run checks for idle instances, defaults to DefaultSweepInterval
+	SweepInterval time.Duration
+
+	// Drives the idle sweeper and Instance.LastAction, defaults to the system clock
+	Clock Clock
+
+	// Default Instance.Transport for new apps, HandleInteractionCreate has to be added as a handler for the component transports
+	Transport Transport
+
+	// Default Instance.IdleWarning for new apps, 0 to disable warnings
+	// Warnings are only as accurate as the SweepInterval
+	IdleWarning time.Duration
+
+	// How often Run saves instances that changed through the StorageBackend, 0 to only save on StopAndSaveStates
+	CheckpointInterval time.Duration
+	// Also save right after a action was handled successfully
+	CheckpointAfterAction bool
+
 	Stopped bool
+
+	// Closed when the engine is stopped
+	stopCh chan struct{}
+
+	// Serializes saving to the storage backend
+	checkpointMU sync.Mutex
+	// States that failed to restore (such as when a migration failed) by id, guarded by checkpointMU
+	// They're kept in storage as they were so they can be restored once fixed
+	failedRestores map[string]*SerializedAppState
 }
 
 func NewEngine() *Engine {
-	return &Engine{}
+	return &Engine{
+		stopCh: make(chan struct{}),
+	}
 }
 
-func (e *Engine) Run() {
-	ticker := time.NewTicker(time.Second * 10)
-	for {
-		<-ticker.C
+// Now returns the current time according to the engine's clock
+func (e *Engine) Now() time.Time {
+	if e.Clock == nil {
+		return realClock{}.Now()
+	}
 
-		e.RLock()
-		runningCop := make([]*Instance, len(e.CurrentInstances))
-		copy(runningCop, e.CurrentInstances)
-		e.RUnlock()
+	return e.Clock.Now()
+}
+
+// Run checks for idle instances every SweepInterval, exiting those that have timed out
+// and saves changed instances every CheckpointInterval if set
+// It returns once the engine is stopped or ctx is cancelled
+func (e *Engine) Run(ctx context.Context) error {
+	clock := e.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	interval := e.SweepInterval
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
 
-		for _, v := range runningCop {
-			v.RLock()
-			if v.IdleTimeout != 0 && time.Now().Sub(v.LastAction) > v.IdleTimeout {
-				v.RUnlock()
-				go func() {
-					v.Lock()
-					v.Exit()
-					v.Unlock()
-				}()
-				logrus.Info("App had idle timeout")
-				continue
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Nil, and thus never firing, if checkpointing is disabled
+	var checkpointC <-chan time.Time
+	if e.CheckpointInterval > 0 {
+		checkpointTicker := clock.NewTicker(e.CheckpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointC = checkpointTicker.C()
+	}
+
+	e.Lock()
+	if e.Stopped {
+		e.Unlock()
+		return nil
+	}
+
+	if e.stopCh == nil {
+		e.stopCh = make(chan struct{})
+	}
+	stopped := e.stopCh
+	e.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stopped:
+			return nil
+		case <-ticker.C():
+			e.sweepIdle()
+		case <-checkpointC:
+			err := e.Checkpoint()
+			if err != nil {
+				logrus.WithError(err).Error("Failed checkpointing apps")
 			}
+		}
+	}
+}
+
+// sweepIdle exits all instances that have not had any actions within their IdleTimeout, warning those about to
+func (e *Engine) sweepIdle() {
+	e.RLock()
+	runningCop := make([]*Instance, len(e.CurrentInstances))
+	copy(runningCop, e.CurrentInstances)
+	e.RUnlock()
+
+	now := e.Now()
+
+	for _, v := range runningCop {
+		v.RLock()
+		if v.IdleTimeout == 0 {
 			v.RUnlock()
+			continue
+		}
+
+		idle := now.Sub(v.LastAction)
+		if idle > v.IdleTimeout {
+			v.RUnlock()
+			go func(inst *Instance) {
+				inst.Lock()
+				inst.Exit(ExitTimeout)
+				inst.Unlock()
+			}(v)
+			logrus.Info("App had idle timeout")
+			continue
+		}
+
+		_, isWarner := v.App.(IdleWarner)
+		shouldWarn := isWarner && v.IdleWarning > 0 && !v.idleWarned && idle > v.IdleTimeout-v.IdleWarning
+		v.RUnlock()
+
+		if shouldWarn {
+			go v.warnIdle()
 		}
 	}
 }
 
 // StartApp starts the specified application, returns an error if the app failed to start
-func (e *Engine) StartApp(session *discordgo.Session, app App, guildID, channelID string, idleTimeout time.Duration) (*Instance, error) {
+func (e *Engine) StartApp(session Session, app App, guildID, channelID string, idleTimeout time.Duration) (*Instance, error) {
 	instance := &Instance{
+		ID:          e.newInstanceID(),
 		App:         app,
 		ChannelID:   channelID,
 		GuildID:     guildID,
 		Engine:      e,
 		Session:     session,
 		IdleTimeout: idleTimeout,
-		LastAction:  time.Now(),
+		IdleWarning: e.IdleWarning,
+		LastAction:  e.Now(),
+		Transport:   e.Transport,
+	}
+
+	err := bindApp(app)
+	if err != nil {
+		return nil, err
 	}
 
-	err := instance.App.Start(instance)
+	// Start may hand the instance to other goroutines already (such as a UserFinder that found everyone)
+	instance.Lock()
+	defer instance.Unlock()
+
+	err = instance.App.Start(instance)
 	if err != nil {
 		return instance, err
 	}
 
 	e.Lock()
 	if e.Stopped {
+		e.Unlock()
 		return nil, ErrStopping
 	}
 
-	e.CurrentInstances = append(e.CurrentInstances, instance)
+	e.addInstance(instance)
 	e.Unlock()
 
 	return instance, nil
 }
 
+// newInstanceID generates a random id that is not used by any running instance
+func (e *Engine) newInstanceID() string {
+	e.RLock()
+	defer e.RUnlock()
+
+	for {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			// Should never happen
+			panic("Failed generating instance id: " + err.Error())
+		}
+
+		id := hex.EncodeToString(b)
+		if _, taken := e.index.byID[id]; !taken {
+			return id
+		}
+	}
+}
+
+// addInstance starts the instance's event queue and adds it to the running instances, the engine has to be locked
+func (e *Engine) addInstance(instance *Instance) {
+	instance.queue = newEventQueue(e.QueueSize, e.QueuePolicy)
+	go instance.queue.run()
+
+	instance.indexActions()
+
+	e.CurrentInstances = append(e.CurrentInstances, instance)
+	e.index.add(instance)
+}
+
+// removeInstance removes the instance from the running instances, the engine has to be locked
+func (e *Engine) removeInstance(instance *Instance) {
+	for i, v := range e.CurrentInstances {
+		if v == instance {
+			e.CurrentInstances = append(e.CurrentInstances[:i], e.CurrentInstances[i+1:]...)
+			break
+		}
+	}
+
+	e.index.remove(instance)
+}
+
+// QueueStats returns the combined event queue statistics of all running instances
+func (e *Engine) QueueStats() QueueStats {
+	e.RLock()
+	defer e.RUnlock()
+
+	var total QueueStats
+	for _, v := range e.CurrentInstances {
+		stats := v.QueueStats()
+		total.Depth += stats.Depth
+		total.Capacity += stats.Capacity
+		total.Processed += stats.Processed
+		total.Dropped += stats.Dropped
+		if stats.MaxDepth > total.MaxDepth {
+			total.MaxDepth = stats.MaxDepth
+		}
+	}
+
+	return total
+}
+
 // HandleMessageReactionAdd is supposed to be added as a discord handler
 // it handles incomming Reaction Add events to be further processed
 func (e *Engine) HandleMessageReactionAdd(s *discordgo.Session, ra *discordgo.MessageReactionAdd) {
+	e.handleReaction(s, ra.MessageReaction, true)
+}
+
+// HandleMessageReactionRemove is supposed to be added as a discord handler
+// it handles incomming Reaction Remove events to be further processed
+func (e *Engine) HandleMessageReactionRemove(s *discordgo.Session, rr *discordgo.MessageReactionRemove) {
+	e.handleReaction(s, rr.MessageReaction, false)
+}
+
+func (e *Engine) handleReaction(s *discordgo.Session, r *discordgo.MessageReaction, added bool) {
+	// Ignore our own reactions, we add and remove those ourselves when managing actions
+	if s != nil && s.State != nil && s.State.User != nil && s.State.User.ID == r.UserID {
+		return
+	}
+
+	e.RLock()
+	if e.Stopped {
+		e.RUnlock()
+		return
+	}
+
+	// Only the instances with actions on the message, usually just the one
+	targets := copyInstances(e.index.byMessage[r.MessageID])
+	e.RUnlock()
+
+	// Pushing may block depending on the queue policy, so do it outside the engine lock
+	for _, instance := range targets {
+		inst := instance
+		inst.queue.push(func() {
+			inst.handleReaction(r.UserID, r.MessageID, r.Emoji, added)
+		})
+	}
+}
+
+// HandleMessageCreate is supposed to be added as a discord handler
+// it passes messages sent by users to the instances in the channel implementing MessageApp
+// Requires discordgo.IntentsMessageContent on the session, see MessageApp
+func (e *Engine) HandleMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author == nil || m.Author.Bot {
+		return
+	}
+
+	// Ignore our own messages
+	if s != nil && s.State != nil && s.State.User != nil && s.State.User.ID == m.Author.ID {
+		return
+	}
+
 	e.RLock()
 	if e.Stopped {
 		e.RUnlock()
 		return
 	}
 
-	for _, instance := range e.CurrentInstances {
-		if instance.ChannelID == ra.ChannelID {
-			go instance.handleReactionAdd(s, ra)
+	var targets []*Instance
+	for _, inst := range e.index.byChannel[m.ChannelID] {
+		if _, ok := inst.App.(MessageApp); ok {
+			targets = append(targets, inst)
 		}
 	}
+	e.RUnlock()
+
+	for _, instance := range targets {
+		inst := instance
+		inst.queue.push(func() {
+			inst.handleMessage(m.Message)
+		})
+	}
+}
+
+// HandleMessageDelete is supposed to be added as a discord handler
+// it drops the actions on the deleted message, exiting the instance owning them unless it implements MessageDeleteHandler
+func (e *Engine) HandleMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	e.handleMessagesDeleted([]string{m.ID})
+}
+
+// HandleMessageDeleteBulk is supposed to be added as a discord handler
+// same as HandleMessageDelete but for multiple messages
+func (e *Engine) HandleMessageDeleteBulk(s *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+	e.handleMessagesDeleted(m.Messages)
+}
+
+func (e *Engine) handleMessagesDeleted(messageIDs []string) {
+	e.RLock()
+	if e.Stopped {
+		e.RUnlock()
+		return
+	}
 
+	// Group the messages by the instances that had actions on them
+	var targets []*Instance
+	deleted := make(map[*Instance][]string)
+	for _, msgID := range messageIDs {
+		for _, inst := range e.index.byMessage[msgID] {
+			if _, ok := deleted[inst]; !ok {
+				targets = append(targets, inst)
+			}
+			deleted[inst] = append(deleted[inst], msgID)
+		}
+	}
 	e.RUnlock()
+
+	for _, instance := range targets {
+		inst := instance
+		ids := deleted[inst]
+		inst.queue.push(func() {
+			inst.handleMessagesDeleted(ids)
+		})
+	}
+}
+
+// HandleChannelDelete is supposed to be added as a discord handler
+// it exits all instances in the channel with ExitChannelGone
+func (e *Engine) HandleChannelDelete(s *discordgo.Session, c *discordgo.ChannelDelete) {
+	e.exitGone(e.FindByChannel(c.ID))
+}
+
+// HandleGuildDelete is supposed to be added as a discord handler
+// it exits all instances in the guild with ExitChannelGone when the bot is removed from it
+func (e *Engine) HandleGuildDelete(s *discordgo.Session, g *discordgo.GuildDelete) {
+	if g.Unavailable {
+		// Outage, it will be back
+		return
+	}
+
+	e.exitGone(e.FindByGuild(g.ID))
+}
+
+func (e *Engine) exitGone(instances []*Instance) {
+	e.RLock()
+	stopped := e.Stopped
+	e.RUnlock()
+	if stopped {
+		return
+	}
+
+	// Through the queue so events already queued are handled first
+	for _, instance := range instances {
+		inst := instance
+		inst.queue.push(func() {
+			inst.Lock()
+			inst.Exit(ExitChannelGone)
+			inst.Unlock()
+		})
+	}
 }
 
 func (e *Engine) StopAndSaveStates() error {
+	storage := e.storage()
+
 	e.Lock()
 	if e.Stopped {
 		e.Unlock()
 		return nil
 	}
 
-	if e.StorageBackend == nil {
-		e.StorageBackend = &FSStorageBackend{Path: "drai_apps.json"}
-		logrus.Warn("No storage backend specified, using default fs backend: drai_apps.json")
+	e.Stopped = true
+	if e.stopCh != nil {
+		close(e.stopCh)
 	}
 
-	e.Stopped = true
+	running := make([]*Instance, len(e.CurrentInstances))
+	copy(running, e.CurrentInstances)
+	e.Unlock()
+
+	toSave := make([]*Instance, 0, len(running))
+	for _, v := range running {
+		if _, ok := registeredAppID(v.App); ok {
+			toSave = append(toSave, v)
+			continue
+		}
+
+		// Unregistered apps can't be restored, so they won't be coming back
+		v.Lock()
+		v.Exit(ExitShutdown)
+		v.Unlock()
+	}
+
+	// Stop handling events before serializing, so nothing the users see happens after the final save
+	for _, v := range toSave {
+		v.queue.close()
+		v.queue.wait()
+	}
 
-	err := e.StorageBackend.SaveApps(e.CurrentInstances)
+	err := e.saveInstances(storage, toSave, true)
+
+	for _, v := range toSave {
+		v.Session.ChannelMessageSend(v.ChannelID, "Engine is being shut down.\nApps running in this channel will be saved and started again once the engine is running.")
+	}
+
+	return err
+}
+
+func (e *Engine) RestoreApps(session Session) error {
+	states, err := e.storage().LoadApps()
 	if err != nil {
 		return err
 	}
 
-	e.Unlock()
+	for _, sas := range states {
+		// Not holding the engine lock, since the app may use the instance methods that update the index
+		instance, err := restoreInstance(e, session, sas)
+		if err != nil {
+			logrus.WithError(err).WithField("app_id", sas.AppID).Error("Failed loading app state")
+
+			e.checkpointMU.Lock()
+			if e.failedRestores == nil {
+				e.failedRestores = make(map[string]*SerializedAppState)
+			}
+			e.failedRestores[sas.ID] = sas
+			e.checkpointMU.Unlock()
+			continue
+		}
+
+		e.Lock()
+		e.addInstance(instance)
+		e.Unlock()
+
+		session.ChannelMessageSend(sas.ChannelID, "Engine has now started again and will act on reactions again.")
+	}
 
 	return nil
 }
 
-func (e *Engine) RestoreApps(session *discordgo.Session) error {
+// storage returns the storage backend, setting it to the default fs backend if none was specified
+func (e *Engine) storage() StorageBackend {
 	e.Lock()
+	defer e.Unlock()
+
 	if e.StorageBackend == nil {
 		e.StorageBackend = &FSStorageBackend{Path: "drai_apps.json"}
 		logrus.Warn("No storage backend specified, using default fs backend: drai_apps.json")
 	}
 
-	apps, err := e.StorageBackend.LoadApps(e, session)
+	return e.StorageBackend
+}
+
+// Checkpoint saves all running instances that changed since they were last saved through the storage backend,
+// and deletes saved instances that are no longer running
+func (e *Engine) Checkpoint() error {
+	storage := e.storage()
+
+	e.RLock()
+	running := make([]*Instance, len(e.CurrentInstances))
+	copy(running, e.CurrentInstances)
+	e.RUnlock()
+
+	err := e.saveInstances(storage, running, false)
 	if err != nil {
 		return err
 	}
 
-	e.CurrentInstances = apps
+	return e.deleteStale(storage)
+}
 
-	e.Unlock()
+// checkpointInstance saves a single instance if it changed since it was last saved
+func (e *Engine) checkpointInstance(inst *Instance) error {
+	return e.saveInstances(e.storage(), []*Instance{inst}, false)
+}
+
+// saveInstances serializes the instances and saves them
+// If force is false, only instances that changed since they were last saved are serialized and saved individually,
+// otherwise all of them are serialized and saved together, replacing everything previously saved
+func (e *Engine) saveInstances(storage StorageBackend, instances []*Instance, force bool) error {
+	e.checkpointMU.Lock()
+	defer e.checkpointMU.Unlock()
+
+	if !force {
+		e.RLock()
+		stopped := e.Stopped
+		e.RUnlock()
+
+		if stopped {
+			// Don't overwrite the final save with a older checkpoint
+			return nil
+		}
+	}
+
+	var allStates, changedStates []*SerializedAppState
+	for _, v := range instances {
+		v.Lock()
+		if v.exited {
+			v.Unlock()
+			continue
+		}
+
+		if force || v.dirty || v.saved == nil {
+			state, err := serializeInstance(v)
+			if err != nil {
+				logrus.WithError(err).Error("Failed serializing app")
+			} else {
+				v.saved = state
+				v.dirty = false
+				changedStates = append(changedStates, state)
+			}
+		}
+
+		if v.saved != nil {
+			allStates = append(allStates, v.saved)
+		}
+		v.Unlock()
+	}
+
+	if force {
+		for _, v := range e.failedRestores {
+			allStates = append(allStates, v)
+		}
+
+		return storage.SaveApps(allStates)
+	}
+
+	for _, v := range changedStates {
+		err := storage.SaveInstance(v)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// deleteStale deletes saved instances that are not running, such as ones that failed to be deleted on exit
+// States that failed to restore are left alone
+func (e *Engine) deleteStale(storage StorageBackend) error {
+	e.checkpointMU.Lock()
+	defer e.checkpointMU.Unlock()
+
+	ids, err := storage.ListInstances()
+	if err != nil {
+		return err
+	}
+
+	// Looked up while holding checkpointMU, instances started since the checkpoint began
+	// may have been saved by checkpointInstance already
+	e.RLock()
+	runningIDs := make(map[string]bool, len(e.CurrentInstances))
+	for _, v := range e.CurrentInstances {
+		runningIDs[v.ID] = true
+	}
+	e.RUnlock()
+
+	for _, id := range ids {
+		if runningIDs[id] || e.failedRestores[id] != nil {
+			continue
+		}
+
+		err = storage.DeleteInstance(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteInstance removes a exited instance from storage
+func (e *Engine) deleteInstance(id string) {
+	storage := e.storage()
+
+	// Waits for any checkpoint that may be saving the instance to finish first
+	e.checkpointMU.Lock()
+	defer e.checkpointMU.Unlock()
+
+	err := storage.DeleteInstance(id)
+	if err != nil {
+		logrus.WithError(err).WithField("instance", id).Error("Failed deleting instance from storage")
+	}
+}
+
 // Action represents a registered action for apps
 type Action struct {
 	UserData
 
-	Emoji     string
+	Emoji     Emoji
 	MessageID string
 
-	RemoveReactionOnSuccess      bool
+	// Remove the user's reaction after HandleAction returned without error
+	RemoveReactionOnSuccess bool
+	// Remove reactions from users not whitelisted on the instance or denied by access rules
 	RemoveReactionNotWhitelisted bool
+	// Note: The remove events of reactions removed by these are not passed to ToggleApps if they arrive within 10 seconds
+
+	// Restricts who may use this action on top of the instance's whitelist and access rules
+	Access *AccessRules
 
-	// Currently unused
+	// Name of the registered action handler to call when this action is used, see RegisterActionHandler
+	// App.HandleAction is called instead if this is empty
 	Name string
+
+	// Shown next to the emoji when using the button or select menu transport
+	Label string
+	// Style of the button when using the button transport, defaults to secondary
+	ButtonStyle discordgo.ButtonStyle
 }
 
 func (a *Action) Equal(other *Action) bool {
-	if a.MessageID == other.MessageID && a.Emoji == other.Emoji {
+	if a.MessageID == other.MessageID && a.Emoji.Equal(other.Emoji) {
 		return true
 	}
 
 	return false
 }
 
+// UserData stores arbitrary data on a action, the types of the values are kept when saved and restored
+// as long as they're one of the types with a accessor below (or any other int, uint or float type), other values are restored
+// as they would be by encoding/json
 type UserData struct {
-	M map[string]interface{}
+	M UserDataMap
+}
+
+// copy returns a copy of the action that can be read while the original is being modified
+func (a *Action) copy() *Action {
+	cop := *a
+	cop.UserData = a.UserData.copy()
+	cop.Access = a.Access.copy()
+	return &cop
+}
+
+func copyActions(actions []*Action) []*Action {
+	if actions == nil {
+		return nil
+	}
+
+	result := make([]*Action, len(actions))
+	for i, v := range actions {
+		result[i] = v.copy()
+	}
+
+	return result
+}
+
+func (u UserData) copy() UserData {
+	if u.M == nil {
+		return u
+	}
+
+	m := make(UserDataMap, len(u.M))
+	for k, v := range u.M {
+		switch t := v.(type) {
+		case UserData:
+			v = t.copy()
+		case []byte:
+			v = append([]byte(nil), t...)
+		case []string:
+			v = append([]string(nil), t...)
+		}
+
+		m[k] = v
+	}
+
+	return UserData{M: m}
 }
 
 func (u *UserData) Set(key string, val interface{}) {
 	if u.M == nil {
-		u.M = make(map[string]interface{})
+		u.M = make(UserDataMap)
 	}
 
 	u.M[key] = val
@@ -179,7 +741,7 @@ func (u *UserData) Set(key string, val interface{}) {
 
 func (u *UserData) Get(key string) (interface{}, bool) {
 	if u.M == nil {
-		u.M = make(map[string]interface{})
+		u.M = make(UserDataMap)
 	}
 
 	v, ok := u.M[key]
@@ -222,6 +784,30 @@ func (u *UserData) Int64(key string) (v int64, ok bool) {
 		case int64:
 			v = t
 			ok = true
+		case int8:
+			v = int64(t)
+			ok = true
+		case int16:
+			v = int64(t)
+			ok = true
+		case int32:
+			v = int64(t)
+			ok = true
+		case uint:
+			v = int64(t)
+			ok = true
+		case uint8:
+			v = int64(t)
+			ok = true
+		case uint16:
+			v = int64(t)
+			ok = true
+		case uint32:
+			v = int64(t)
+			ok = true
+		case uint64:
+			v = int64(t)
+			ok = true
 		case float64:
 			v = int64(t)
 			ok = true
@@ -241,3 +827,104 @@ func (u *UserData) Int(key string) (v int, ok bool) {
 
 	return
 }
+
+func (u *UserData) Float64(key string) (v float64, ok bool) {
+	if iv, ok2 := u.Get(key); ok2 {
+		switch t := iv.(type) {
+		case float64:
+			v = t
+			ok = true
+		case float32:
+			v = float64(t)
+			ok = true
+		default:
+			var i int64
+			if i, ok = u.Int64(key); ok {
+				v = float64(i)
+			}
+		}
+	}
+
+	return
+}
+
+func (u *UserData) Time(key string) (v time.Time, ok bool) {
+	if iv, ok2 := u.Get(key); ok2 {
+		switch t := iv.(type) {
+		case time.Time:
+			v = t
+			ok = true
+		case string:
+			// Saved before values had types
+			parsed, err := time.Parse(time.RFC3339Nano, t)
+			if err == nil {
+				v = parsed
+				ok = true
+			}
+		}
+	}
+
+	return
+}
+
+func (u *UserData) Duration(key string) (v time.Duration, ok bool) {
+	if iv, ok2 := u.Get(key); ok2 {
+		switch t := iv.(type) {
+		case time.Duration:
+			v = t
+			ok = true
+		default:
+			var i int64
+			if i, ok = u.Int64(key); ok {
+				v = time.Duration(i)
+			}
+		}
+	}
+
+	return
+}
+
+func (u *UserData) StringSlice(key string) (v []string, ok bool) {
+	if iv, ok2 := u.Get(key); ok2 {
+		switch t := iv.(type) {
+		case []string:
+			v = t
+			ok = true
+		case []interface{}:
+			// Saved before values had types
+			v = make([]string, 0, len(t))
+			for _, elem := range t {
+				str, isStr := elem.(string)
+				if !isStr {
+					return nil, false
+				}
+				v = append(v, str)
+			}
+			ok = true
+		}
+	}
+
+	return
+}
+
+// Nested returns UserData stored inside this one, set it with Set(key, UserData{...})
+func (u *UserData) Nested(key string) (v UserData, ok bool) {
+	if iv, ok2 := u.Get(key); ok2 {
+		switch t := iv.(type) {
+		case UserData:
+			v = t
+			ok = true
+		case *UserData:
+			if t != nil {
+				v = *t
+				ok = true
+			}
+		case map[string]interface{}:
+			// Saved before values had types
+			v = UserData{M: UserDataMap(t)}
+			ok = true
+		}
+	}
+
+	return
+}
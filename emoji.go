@@ -0,0 +1,114 @@
+package drai
+
+import (
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// Emoji is the unicode or custom guild emoji of a action
+type Emoji struct {
+	// The unicode emoji itself, or the name of a custom emoji
+	Name string `json:"name"`
+
+	// Only set for custom emojis
+	ID       string `json:"id,omitempty"`
+	Animated bool   `json:"animated,omitempty"`
+}
+
+func UnicodeEmoji(emoji string) Emoji {
+	return Emoji{Name: emoji}
+}
+
+func CustomEmoji(name, id string, animated bool) Emoji {
+	return Emoji{Name: name, ID: id, Animated: animated}
+}
+
+// EmojiFromDiscord converts a discordgo emoji, such as the one in a reaction event
+func EmojiFromDiscord(e discordgo.Emoji) Emoji {
+	return Emoji{Name: e.Name, ID: e.ID, Animated: e.Animated}
+}
+
+// ParseEmoji parses a emoji in either the message format (<:name:id>, <a:name:id>) or the api format (name:id)
+// Anything else is treated as a unicode emoji
+func ParseEmoji(s string) Emoji {
+	animated := false
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")
+		if strings.HasPrefix(s, "a:") {
+			animated = true
+			s = strings.TrimPrefix(s, "a")
+		}
+		s = strings.TrimPrefix(s, ":")
+	}
+
+	split := strings.Split(s, ":")
+	if len(split) != 2 || split[1] == "" {
+		return UnicodeEmoji(s)
+	}
+
+	return CustomEmoji(split[0], split[1], animated)
+}
+
+func (e Emoji) IsCustom() bool {
+	return e.ID != ""
+}
+
+// APIName returns the emoji in the format used by the add and remove reaction endpoints
+func (e Emoji) APIName() string {
+	if e.IsCustom() {
+		return e.Name + ":" + e.ID
+	}
+
+	return e.Name
+}
+
+// String returns the emoji in the format used in message content
+func (e Emoji) String() string {
+	if !e.IsCustom() {
+		return e.Name
+	}
+
+	if e.Animated {
+		return "<a:" + e.Name + ":" + e.ID + ">"
+	}
+
+	return "<:" + e.Name + ":" + e.ID + ">"
+}
+
+// Equal returns true if both are the same emoji, custom emojis are compared by id only
+func (e Emoji) Equal(other Emoji) bool {
+	return e.key() == other.key()
+}
+
+// Matches returns true if e is the same emoji as the one from discord
+func (e Emoji) Matches(other discordgo.Emoji) bool {
+	return e.Equal(EmojiFromDiscord(other))
+}
+
+// key uniquely identifies the emoji, custom emojis can have the same name as other custom emojis in other guilds
+func (e Emoji) key() string {
+	if e.IsCustom() {
+		return e.ID
+	}
+
+	return e.Name
+}
+
+// UnmarshalJSON also accepts the plain strings actions used to be saved with
+func (e *Emoji) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+
+		*e = ParseEmoji(s)
+		return nil
+	}
+
+	// Alias to avoid recursing back into this method
+	type emoji Emoji
+	return json.Unmarshal(data, (*emoji)(e))
+}
@@ -0,0 +1,525 @@
+package drai
+
+import (
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrUnknownMessage   = errors.New("Unknown message")
+	ErrUnknownComponent = errors.New("Unknown component")
+)
+
+// FakeSession is a in-memory Session that records messages and reactions, for testing apps without a connection to discord
+// Use SimulateReactionAdd and SimulateReactionRemove to act as users clicking on reactions, SimulateMessageCreate to act as users typing,
+// SimulateButtonClick and SimulateSelectMenu to act as users using components,
+// and SimulateMessageDelete and SimulateChannelDelete to act as moderators deleting things
+// Request options are accepted but ignored
+type FakeSession struct {
+	sync.Mutex
+
+	// The user id the fake session's own reactions and messages are made as
+	BotUserID string
+
+	// All messages sent and not deleted, by message id
+	Messages map[string]*discordgo.Message
+	// Message ids in the order they were sent
+	MessageOrder []string
+
+	// Reactions currently on messages, by message id
+	Reactions map[string][]*FakeReaction
+
+	// Members returned by GuildMember, by guild id then user id
+	// If a member is not found a member with the username set to the user id is returned
+	Members map[string]map[string]*discordgo.Member
+
+	// Permissions returned by UserChannelPermissions, by channel id then user id
+	Permissions map[string]map[string]int64
+
+	// Responses to interactions, in the order they were made
+	InteractionResponses []*discordgo.InteractionResponse
+	// Edits of interaction responses, in the order they were made
+	InteractionResponseEdits []*discordgo.WebhookEdit
+
+	// Application commands registered with ApplicationCommandBulkOverwrite, by guild id ("" for global commands)
+	Commands map[string][]*discordgo.ApplicationCommand
+
+	lastID int64
+}
+
+var _ Session = (*FakeSession)(nil)
+
+// FakeReaction is a reaction recorded by FakeSession
+type FakeReaction struct {
+	// In the api format, see Emoji.APIName
+	Emoji  string
+	UserID string
+}
+
+func NewFakeSession() *FakeSession {
+	return &FakeSession{
+		BotUserID: "1",
+		lastID:    1,
+	}
+}
+
+func (f *FakeSession) nextID() string {
+	f.lastID++
+	return strconv.FormatInt(f.lastID, 10)
+}
+
+func (f *FakeSession) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return f.sendMessage(channelID, content, f.BotUserID), nil
+}
+
+func (f *FakeSession) sendMessage(channelID, content, authorID string) *discordgo.Message {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Messages == nil {
+		f.Messages = make(map[string]*discordgo.Message)
+	}
+
+	m := &discordgo.Message{
+		ID:        f.nextID(),
+		ChannelID: channelID,
+		Content:   content,
+		Author:    &discordgo.User{ID: authorID},
+	}
+
+	f.Messages[m.ID] = m
+	f.MessageOrder = append(f.MessageOrder, m.ID)
+
+	cop := *m
+	return &cop
+}
+
+func (f *FakeSession) ChannelMessageEdit(channelID, messageID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	m, ok := f.Messages[messageID]
+	if !ok || m.ChannelID != channelID {
+		return nil, ErrUnknownMessage
+	}
+
+	m.Content = content
+
+	cop := *m
+	return &cop, nil
+}
+
+func (f *FakeSession) ChannelMessageEditComplex(edit *discordgo.MessageEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	m, ok := f.Messages[edit.ID]
+	if !ok || m.ChannelID != edit.Channel {
+		return nil, ErrUnknownMessage
+	}
+
+	if edit.Content != nil {
+		m.Content = *edit.Content
+	}
+
+	if edit.Components != nil {
+		m.Components = append([]discordgo.MessageComponent(nil), *edit.Components...)
+	}
+
+	cop := *m
+	return &cop, nil
+}
+
+func (f *FakeSession) ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if m, ok := f.Messages[messageID]; !ok || m.ChannelID != channelID {
+		return ErrUnknownMessage
+	}
+
+	delete(f.Messages, messageID)
+	delete(f.Reactions, messageID)
+	return nil
+}
+
+func (f *FakeSession) MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error {
+	return f.addReaction(channelID, messageID, emojiID, f.BotUserID)
+}
+
+func (f *FakeSession) MessageReactionRemove(channelID, messageID, emojiID, userID string, options ...discordgo.RequestOption) error {
+	if userID == "@me" {
+		userID = f.BotUserID
+	}
+
+	return f.removeReaction(channelID, messageID, emojiID, userID)
+}
+
+func (f *FakeSession) MessageReactionsRemoveAll(channelID, messageID string, options ...discordgo.RequestOption) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if m, ok := f.Messages[messageID]; !ok || m.ChannelID != channelID {
+		return ErrUnknownMessage
+	}
+
+	delete(f.Reactions, messageID)
+	return nil
+}
+
+func (f *FakeSession) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if m, ok := f.Members[guildID][userID]; ok {
+		return m, nil
+	}
+
+	return &discordgo.Member{
+		GuildID: guildID,
+		User: &discordgo.User{
+			ID:            userID,
+			Username:      userID,
+			Discriminator: "0000",
+		},
+	}, nil
+}
+
+func (f *FakeSession) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.InteractionResponses = append(f.InteractionResponses, resp)
+	return nil
+}
+
+func (f *FakeSession) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.InteractionResponseEdits = append(f.InteractionResponseEdits, newresp)
+
+	m := &discordgo.Message{ChannelID: interaction.ChannelID}
+	if newresp.Content != nil {
+		m.Content = *newresp.Content
+	}
+	return m, nil
+}
+
+func (f *FakeSession) ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Commands == nil {
+		f.Commands = make(map[string][]*discordgo.ApplicationCommand)
+	}
+
+	f.Commands[guildID] = commands
+	return commands, nil
+}
+
+// AddMember adds a member to be returned by GuildMember
+func (f *FakeSession) AddMember(guildID string, member *discordgo.Member) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Members == nil {
+		f.Members = make(map[string]map[string]*discordgo.Member)
+	}
+
+	if f.Members[guildID] == nil {
+		f.Members[guildID] = make(map[string]*discordgo.Member)
+	}
+
+	member.GuildID = guildID
+	f.Members[guildID][member.User.ID] = member
+}
+
+func (f *FakeSession) UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.Permissions[channelID][userID], nil
+}
+
+// SetPermissions sets the permissions returned by UserChannelPermissions
+func (f *FakeSession) SetPermissions(channelID, userID string, permissions int64) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Permissions == nil {
+		f.Permissions = make(map[string]map[string]int64)
+	}
+
+	if f.Permissions[channelID] == nil {
+		f.Permissions[channelID] = make(map[string]int64)
+	}
+
+	f.Permissions[channelID][userID] = permissions
+}
+
+// Message returns a copy of the message, or nil if it does not exist
+func (f *FakeSession) Message(messageID string) *discordgo.Message {
+	f.Lock()
+	defer f.Unlock()
+
+	m, ok := f.Messages[messageID]
+	if !ok {
+		return nil
+	}
+
+	cop := *m
+	return &cop
+}
+
+// ChannelMessages returns copies of all messages in the channel, oldest first
+func (f *FakeSession) ChannelMessages(channelID string) []*discordgo.Message {
+	f.Lock()
+	defer f.Unlock()
+
+	var result []*discordgo.Message
+	for _, id := range f.MessageOrder {
+		m, ok := f.Messages[id]
+		if !ok || m.ChannelID != channelID {
+			continue
+		}
+
+		cop := *m
+		result = append(result, &cop)
+	}
+
+	return result
+}
+
+// MessageReactions returns the reactions currently on the message
+func (f *FakeSession) MessageReactions(messageID string) []FakeReaction {
+	f.Lock()
+	defer f.Unlock()
+
+	result := make([]FakeReaction, 0, len(f.Reactions[messageID]))
+	for _, v := range f.Reactions[messageID] {
+		result = append(result, *v)
+	}
+
+	return result
+}
+
+// SimulateReactionAdd adds a reaction as the user and passes the event to the engine
+// It returns once the engine has processed the event
+func (f *FakeSession) SimulateReactionAdd(engine *Engine, channelID, messageID string, emoji Emoji, userID string) error {
+	err := f.addReaction(channelID, messageID, emoji.APIName(), userID)
+	if err != nil {
+		return err
+	}
+
+	engine.HandleMessageReactionAdd(nil, &discordgo.MessageReactionAdd{
+		MessageReaction: f.messageReaction(channelID, messageID, emoji, userID),
+	})
+	engine.waitQueuesIdle()
+
+	return nil
+}
+
+// SimulateReactionRemove removes the user's reaction and passes the event to the engine
+// It returns once the engine has processed the event
+func (f *FakeSession) SimulateReactionRemove(engine *Engine, channelID, messageID string, emoji Emoji, userID string) error {
+	err := f.removeReaction(channelID, messageID, emoji.APIName(), userID)
+	if err != nil {
+		return err
+	}
+
+	engine.HandleMessageReactionRemove(nil, &discordgo.MessageReactionRemove{
+		MessageReaction: f.messageReaction(channelID, messageID, emoji, userID),
+	})
+	engine.waitQueuesIdle()
+
+	return nil
+}
+
+// SimulateButtonClick clicks the button of the action with the emoji as the user and passes the event to the engine
+// It returns once the engine has processed the event
+func (f *FakeSession) SimulateButtonClick(engine *Engine, channelID, messageID string, emoji Emoji, userID string) error {
+	customID := buttonCustomID(emoji)
+	if !f.hasComponent(channelID, messageID, customID) {
+		return ErrUnknownComponent
+	}
+
+	f.simulateComponent(engine, channelID, messageID, userID, discordgo.MessageComponentInteractionData{
+		CustomID:      customID,
+		ComponentType: discordgo.ButtonComponent,
+	})
+	return nil
+}
+
+// SimulateSelectMenu selects the options of the actions with the emojis as the user and passes the event to the engine
+// It returns once the engine has processed the event
+func (f *FakeSession) SimulateSelectMenu(engine *Engine, channelID, messageID, userID string, emojis ...Emoji) error {
+	if !f.hasComponent(channelID, messageID, selectMenuCustomID) {
+		return ErrUnknownComponent
+	}
+
+	values := make([]string, 0, len(emojis))
+	for _, v := range emojis {
+		values = append(values, v.key())
+	}
+
+	f.simulateComponent(engine, channelID, messageID, userID, discordgo.MessageComponentInteractionData{
+		CustomID:      selectMenuCustomID,
+		ComponentType: discordgo.SelectMenuComponent,
+		Values:        values,
+	})
+	return nil
+}
+
+func (f *FakeSession) simulateComponent(engine *Engine, channelID, messageID, userID string, data discordgo.MessageComponentInteractionData) {
+	engine.HandleInteractionCreate(nil, &discordgo.InteractionCreate{
+		Interaction: &discordgo.Interaction{
+			Type:      discordgo.InteractionMessageComponent,
+			ChannelID: channelID,
+			Message:   &discordgo.Message{ID: messageID, ChannelID: channelID},
+			Member:    &discordgo.Member{User: &discordgo.User{ID: userID}},
+			Data:      data,
+		},
+	})
+	engine.waitQueuesIdle()
+}
+
+// hasComponent returns true if the message has a component with the custom id
+func (f *FakeSession) hasComponent(channelID, messageID, customID string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	m, ok := f.Messages[messageID]
+	if !ok || m.ChannelID != channelID {
+		return false
+	}
+
+	for _, c := range m.Components {
+		row, ok := c.(discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+
+		for _, rc := range row.Components {
+			switch t := rc.(type) {
+			case discordgo.Button:
+				if t.CustomID == customID {
+					return true
+				}
+			case discordgo.SelectMenu:
+				if t.CustomID == customID {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// SimulateMessageCreate sends a message as the user and passes the event to the engine
+// It returns the message once the engine has processed the event
+func (f *FakeSession) SimulateMessageCreate(engine *Engine, channelID, userID, content string) *discordgo.Message {
+	m := f.sendMessage(channelID, content, userID)
+
+	engine.HandleMessageCreate(nil, &discordgo.MessageCreate{Message: m})
+	engine.waitQueuesIdle()
+
+	return m
+}
+
+// SimulateMessageDelete deletes the message as a moderator would and passes the event to the engine
+// It returns once the engine has processed the event
+func (f *FakeSession) SimulateMessageDelete(engine *Engine, channelID, messageID string) error {
+	f.Lock()
+	if m, ok := f.Messages[messageID]; !ok || m.ChannelID != channelID {
+		f.Unlock()
+		return ErrUnknownMessage
+	}
+
+	delete(f.Messages, messageID)
+	delete(f.Reactions, messageID)
+	f.Unlock()
+
+	engine.HandleMessageDelete(nil, &discordgo.MessageDelete{
+		Message: &discordgo.Message{ID: messageID, ChannelID: channelID},
+	})
+	engine.waitQueuesIdle()
+
+	return nil
+}
+
+// SimulateChannelDelete deletes the channel along with its messages and passes the event to the engine
+// It returns once the engine has processed the event
+func (f *FakeSession) SimulateChannelDelete(engine *Engine, channelID string) {
+	f.Lock()
+	for id, m := range f.Messages {
+		if m.ChannelID == channelID {
+			delete(f.Messages, id)
+			delete(f.Reactions, id)
+		}
+	}
+	f.Unlock()
+
+	engine.HandleChannelDelete(nil, &discordgo.ChannelDelete{
+		Channel: &discordgo.Channel{ID: channelID},
+	})
+	engine.waitQueuesIdle()
+}
+
+func (f *FakeSession) messageReaction(channelID, messageID string, emoji Emoji, userID string) *discordgo.MessageReaction {
+	return &discordgo.MessageReaction{
+		ChannelID: channelID,
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji: discordgo.Emoji{
+			Name:     emoji.Name,
+			ID:       emoji.ID,
+			Animated: emoji.Animated,
+		},
+	}
+}
+
+func (f *FakeSession) addReaction(channelID, messageID, emoji, userID string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if m, ok := f.Messages[messageID]; !ok || m.ChannelID != channelID {
+		return ErrUnknownMessage
+	}
+
+	for _, v := range f.Reactions[messageID] {
+		if v.Emoji == emoji && v.UserID == userID {
+			// Already reacted
+			return nil
+		}
+	}
+
+	if f.Reactions == nil {
+		f.Reactions = make(map[string][]*FakeReaction)
+	}
+
+	f.Reactions[messageID] = append(f.Reactions[messageID], &FakeReaction{Emoji: emoji, UserID: userID})
+	return nil
+}
+
+func (f *FakeSession) removeReaction(channelID, messageID, emoji, userID string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if m, ok := f.Messages[messageID]; !ok || m.ChannelID != channelID {
+		return ErrUnknownMessage
+	}
+
+	reactions := f.Reactions[messageID]
+	for i, v := range reactions {
+		if v.Emoji == emoji && v.UserID == userID {
+			f.Reactions[messageID] = append(reactions[:i], reactions[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
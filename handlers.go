@@ -0,0 +1,15 @@
+package drai
+
+// ActionHandlerFunc handles a action, the instance is locked while it's running
+type ActionHandlerFunc func(instance *Instance, userID string, action *Action) error
+
+var (
+	RegisteredActionHandlers = make(map[string]ActionHandlerFunc)
+)
+
+// RegisterActionHandler registers a handler actions can be bound to by setting Action.Name to the handler's name
+// Since only the name is saved, the binding survives the app being saved and restored
+// Names are global, so prefix them with your app's id
+func RegisterActionHandler(name string, handler ActionHandlerFunc) {
+	RegisteredActionHandlers[name] = handler
+}
@@ -0,0 +1,194 @@
+package drai
+
+import (
+	"errors"
+)
+
+var (
+	ErrInstanceNotFound = errors.New("Instance not found")
+)
+
+// instanceIndex keeps the running instances of a engine indexed by id, channel, guild, whitelisted user and action message
+type instanceIndex struct {
+	byID      map[string]*Instance
+	byChannel map[string][]*Instance
+	byGuild   map[string][]*Instance
+	byUser    map[string][]*Instance
+	byMessage map[string][]*Instance
+}
+
+func (idx *instanceIndex) init() {
+	if idx.byID != nil {
+		return
+	}
+
+	idx.byID = make(map[string]*Instance)
+	idx.byChannel = make(map[string][]*Instance)
+	idx.byGuild = make(map[string][]*Instance)
+	idx.byUser = make(map[string][]*Instance)
+	idx.byMessage = make(map[string][]*Instance)
+}
+
+// add indexes the instance, the instance has to be locked (or not shared yet)
+func (idx *instanceIndex) add(inst *Instance) {
+	idx.init()
+
+	idx.byID[inst.ID] = inst
+	idx.byChannel[inst.ChannelID] = append(idx.byChannel[inst.ChannelID], inst)
+	if inst.GuildID != "" {
+		idx.byGuild[inst.GuildID] = append(idx.byGuild[inst.GuildID], inst)
+	}
+
+	idx.addMutable(inst)
+}
+
+// addMutable indexes the parts of the instance that can change while it's running
+func (idx *instanceIndex) addMutable(inst *Instance) {
+	inst.indexedUsers = uniqueStrings(inst.UserIDs)
+	for _, v := range inst.indexedUsers {
+		idx.byUser[v] = append(idx.byUser[v], inst)
+	}
+
+	messages := make([]string, 0, len(inst.Actions))
+	for _, a := range inst.Actions {
+		messages = append(messages, a.MessageID)
+	}
+
+	inst.indexedMessages = uniqueStrings(messages)
+	for _, v := range inst.indexedMessages {
+		idx.byMessage[v] = append(idx.byMessage[v], inst)
+	}
+}
+
+func (idx *instanceIndex) remove(inst *Instance) {
+	if idx.byID[inst.ID] != inst {
+		return
+	}
+
+	delete(idx.byID, inst.ID)
+	removeIndexed(idx.byChannel, inst.ChannelID, inst)
+	removeIndexed(idx.byGuild, inst.GuildID, inst)
+	idx.removeMutable(inst)
+}
+
+func (idx *instanceIndex) removeMutable(inst *Instance) {
+	for _, v := range inst.indexedUsers {
+		removeIndexed(idx.byUser, v, inst)
+	}
+
+	for _, v := range inst.indexedMessages {
+		removeIndexed(idx.byMessage, v, inst)
+	}
+
+	inst.indexedUsers = nil
+	inst.indexedMessages = nil
+}
+
+// update reindexes the users and messages of the instance if it's running, the instance has to be locked
+func (idx *instanceIndex) update(inst *Instance) {
+	if idx.byID[inst.ID] != inst {
+		return
+	}
+
+	idx.removeMutable(inst)
+	idx.addMutable(inst)
+}
+
+func removeIndexed(m map[string][]*Instance, key string, inst *Instance) {
+	list := m[key]
+	for i, v := range list {
+		if v == inst {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+
+	if len(list) < 1 {
+		delete(m, key)
+	} else {
+		m[key] = list
+	}
+}
+
+func uniqueStrings(s []string) []string {
+	result := make([]string, 0, len(s))
+	for _, v := range s {
+		if !containsString(result, v) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+// FindByID returns the running instance with the id, or nil if there is none
+func (e *Engine) FindByID(id string) *Instance {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.index.byID[id]
+}
+
+// FindByChannel returns the instances running in the channel
+func (e *Engine) FindByChannel(channelID string) []*Instance {
+	e.RLock()
+	defer e.RUnlock()
+
+	return copyInstances(e.index.byChannel[channelID])
+}
+
+// FindByGuild returns the instances running in the guild
+func (e *Engine) FindByGuild(guildID string) []*Instance {
+	e.RLock()
+	defer e.RUnlock()
+
+	return copyInstances(e.index.byGuild[guildID])
+}
+
+// FindByUser returns the instances that have the user whitelisted, instances with AllowAllUsers set are not included
+func (e *Engine) FindByUser(userID string) []*Instance {
+	e.RLock()
+	defer e.RUnlock()
+
+	return copyInstances(e.index.byUser[userID])
+}
+
+// FindByMessage returns the instances that have actions on the message
+func (e *Engine) FindByMessage(messageID string) []*Instance {
+	e.RLock()
+	defer e.RUnlock()
+
+	return copyInstances(e.index.byMessage[messageID])
+}
+
+// StopInstance exits the running instance with the id with ExitCancelled
+func (e *Engine) StopInstance(id string) error {
+	inst := e.FindByID(id)
+	if inst == nil {
+		return ErrInstanceNotFound
+	}
+
+	inst.Lock()
+	inst.Exit(ExitCancelled)
+	inst.Unlock()
+	return nil
+}
+
+func copyInstances(instances []*Instance) []*Instance {
+	if len(instances) < 1 {
+		return nil
+	}
+
+	return append([]*Instance(nil), instances...)
+}
+
+// reindex updates the engine's index after the instance's users or actions changed, the instance has to be locked
+func (i *Instance) reindex() {
+	if i.Engine == nil {
+		return
+	}
+
+	i.Engine.Lock()
+	i.Engine.index.update(i)
+	i.Engine.Unlock()
+}
@@ -0,0 +1,198 @@
+package drai
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultQueueSize = 100
+
+// QueuePolicy decides what happens to incoming events when an instance's event queue is full
+type QueuePolicy int
+
+const (
+	// Block the discord event handler until there's room in the queue
+	// Note: With SyncEvents enabled on the session, one full queue holds up the dispatch of all other discord events aswell
+	QueuePolicyBlock QueuePolicy = iota
+
+	// Drop the incoming event
+	QueuePolicyDropNewest
+
+	// Drop the oldest queued event to make room for the incoming one
+	QueuePolicyDropOldest
+)
+
+// QueueStats contains statistics about a instance's event queue
+type QueueStats struct {
+	// Number of events currently waiting to be processed
+	Depth int
+	// Highest number of events that have been waiting at once
+	MaxDepth int
+	Capacity int
+
+	Processed int64
+	Dropped   int64
+}
+
+// eventQueue is a bounded mailbox with a single worker, delivering events to the instance in the order they were pushed
+type eventQueue struct {
+	events chan func()
+	policy QueuePolicy
+
+	// Serializes pushes so events keep their order and the drop policies don't race
+	pushMU sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Closed by the worker once it stopped
+	done chan struct{}
+
+	// Events that have been pushed but not yet fully processed or dropped
+	pending int64
+
+	maxDepth  int64
+	processed int64
+	dropped   int64
+}
+
+func newEventQueue(size int, policy QueuePolicy) *eventQueue {
+	if size < 1 {
+		size = DefaultQueueSize
+	}
+
+	return &eventQueue{
+		events: make(chan func(), size),
+		policy: policy,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run processes events until the queue is stopped
+func (q *eventQueue) run() {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case ev := <-q.events:
+			select {
+			case <-q.stop:
+				// Both were ready, the stop wins so no events are handled after close returned
+				return
+			default:
+			}
+
+			ev()
+			atomic.AddInt64(&q.processed, 1)
+			atomic.AddInt64(&q.pending, -1)
+		}
+	}
+}
+
+// push adds a event to the queue according to the queue's policy, returns false if it was dropped
+func (q *eventQueue) push(ev func()) bool {
+	q.pushMU.Lock()
+	defer q.pushMU.Unlock()
+
+	select {
+	case <-q.stop:
+		return false
+	default:
+	}
+
+	// Counted before the event is visible to the worker, so pending never goes negative
+	atomic.AddInt64(&q.pending, 1)
+
+	switch q.policy {
+	case QueuePolicyDropNewest:
+		select {
+		case q.events <- ev:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+			atomic.AddInt64(&q.pending, -1)
+			return false
+		}
+	case QueuePolicyDropOldest:
+		for pushed := false; !pushed; {
+			select {
+			case q.events <- ev:
+				pushed = true
+			default:
+				// Make room by dropping the oldest event, unless the worker beat us to it
+				select {
+				case <-q.events:
+					atomic.AddInt64(&q.dropped, 1)
+					atomic.AddInt64(&q.pending, -1)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case q.events <- ev:
+		case <-q.stop:
+			atomic.AddInt64(&q.pending, -1)
+			return false
+		}
+	}
+
+	depth := int64(len(q.events))
+	if depth > atomic.LoadInt64(&q.maxDepth) {
+		atomic.StoreInt64(&q.maxDepth, depth)
+	}
+
+	return true
+}
+
+// close stops the worker, events still in the queue are discarded
+// Safe to call from within a event
+func (q *eventQueue) close() {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+}
+
+// wait blocks until the worker stopped, finishing the event it was processing when the queue was closed
+// Must not be called from within a event
+func (q *eventQueue) wait() {
+	<-q.done
+}
+
+// idle returns true if there are no events waiting or being processed
+func (q *eventQueue) idle() bool {
+	return atomic.LoadInt64(&q.pending) == 0
+}
+
+func (q *eventQueue) stats() QueueStats {
+	return QueueStats{
+		Depth:     len(q.events),
+		MaxDepth:  int(atomic.LoadInt64(&q.maxDepth)),
+		Capacity:  cap(q.events),
+		Processed: atomic.LoadInt64(&q.processed),
+		Dropped:   atomic.LoadInt64(&q.dropped),
+	}
+}
+
+// waitQueuesIdle blocks until all running instances have processed their queued events
+func (e *Engine) waitQueuesIdle() {
+	for {
+		e.RLock()
+		idle := true
+		for _, v := range e.CurrentInstances {
+			if !v.queue.idle() {
+				idle = false
+				break
+			}
+		}
+		e.RUnlock()
+
+		if idle {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
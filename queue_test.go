@@ -0,0 +1,189 @@
+package drai
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// queueRecorder records the order events were delivered in
+type queueRecorder struct {
+	mu        sync.Mutex
+	delivered []int
+}
+
+func (r *queueRecorder) event(n int) func() {
+	return func() {
+		r.mu.Lock()
+		r.delivered = append(r.delivered, n)
+		r.mu.Unlock()
+	}
+}
+
+func (r *queueRecorder) get() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.delivered...)
+}
+
+// waitQueueIdle waits for the worker to process everything that was pushed
+func waitQueueIdle(t *testing.T, q *eventQueue) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !q.idle() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the queue to be processed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestQueuePolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    QueuePolicy
+		pushed    []bool
+		delivered []int
+		dropped   int64
+	}{
+		{"block", QueuePolicyBlock, []bool{true, true, true}, []int{1, 2, 3}, 0},
+		{"drop newest", QueuePolicyDropNewest, []bool{true, true, false}, []int{1, 2}, 1},
+		{"drop oldest", QueuePolicyDropOldest, []bool{true, true, true}, []int{2, 3}, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &queueRecorder{}
+			q := newEventQueue(2, tc.policy)
+
+			// Fill the queue before the worker runs, the third push finds it full
+			pushed := make([]bool, 3)
+			pushed[0] = q.push(rec.event(1))
+			pushed[1] = q.push(rec.event(2))
+
+			thirdDone := make(chan bool)
+			go func() {
+				thirdDone <- q.push(rec.event(3))
+			}()
+
+			if tc.policy == QueuePolicyBlock {
+				// Counted as pending before it blocks
+				for atomic.LoadInt64(&q.pending) < 3 {
+					time.Sleep(time.Millisecond)
+				}
+
+				select {
+				case <-thirdDone:
+					t.Fatal("Push into a full queue didn't block")
+				case <-time.After(time.Millisecond * 10):
+				}
+
+				go q.run()
+				pushed[2] = <-thirdDone
+			} else {
+				pushed[2] = <-thirdDone
+				go q.run()
+			}
+
+			waitQueueIdle(t, q)
+
+			for i := range pushed {
+				if pushed[i] != tc.pushed[i] {
+					t.Errorf("Push %d returned %v, expected %v", i+1, pushed[i], tc.pushed[i])
+				}
+			}
+
+			if got := rec.get(); !equalInts(got, tc.delivered) {
+				t.Errorf("Delivered %v, expected %v", got, tc.delivered)
+			}
+
+			stats := q.stats()
+			if stats.Dropped != tc.dropped || stats.MaxDepth != 2 || stats.Capacity != 2 || stats.Processed != int64(len(tc.delivered)) || stats.Depth != 0 {
+				t.Errorf("Unexpected stats: %#v", stats)
+			}
+
+			q.close()
+			q.wait()
+		})
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	rec := &queueRecorder{}
+	q := newEventQueue(4, QueuePolicyBlock)
+	go q.run()
+
+	expected := make([]int, 100)
+	for i := range expected {
+		expected[i] = i
+		q.push(rec.event(i))
+	}
+
+	waitQueueIdle(t, q)
+	if got := rec.get(); !equalInts(got, expected) {
+		t.Fatal("Events delivered out of order:", got)
+	}
+
+	if stats := q.stats(); stats.Processed != 100 || stats.Dropped != 0 || stats.MaxDepth > 4 {
+		t.Fatalf("Unexpected stats: %#v", stats)
+	}
+
+	q.close()
+	q.wait()
+}
+
+func TestQueueClose(t *testing.T) {
+	rec := &queueRecorder{}
+	q := newEventQueue(4, QueuePolicyBlock)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	q.push(func() {
+		close(started)
+		<-release
+		rec.event(1)()
+	})
+	q.push(rec.event(2))
+	go q.run()
+
+	<-started
+	q.close()
+
+	waited := make(chan bool)
+	go func() {
+		q.wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("wait returned while a event was still being processed")
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	close(release)
+	<-waited
+
+	// The event being processed finishes, the queued one is discarded
+	if got := rec.get(); !equalInts(got, []int{1}) {
+		t.Fatal("Expected only the first event to be delivered, got", got)
+	}
+
+	if q.push(rec.event(3)) {
+		t.Fatal("Pushed to a closed queue")
+	}
+}
@@ -0,0 +1,188 @@
+// Package redisstorage is a drai storage backend saving application states in redis
+//
+// It's in its own package so only users of it depend on a redis client
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/jonas747/drai"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrNoNamespace = errors.New("No namespace set on the redis storage backend")
+)
+
+// Backend saves each application state under its own key, with a set of the saved instance ids as index
+// Useful when running on multiple hosts, or anywhere the local filesystem doesn't survive redeploys
+//
+// Every engine sharing a redis needs its own Namespace: a engine treats everything saved in its namespace as its own,
+// so checkpoints delete the instances it isn't running and StopAndSaveStates replaces all of them.
+// Use something that stays the same across restarts (such as a shard or container name), so the engine restores its own instances
+type Backend struct {
+	Client redis.UniversalClient
+
+	// Required, keys are prefixed with "drai:<namespace>:"
+	Namespace string
+
+	// The codec states are written with, defaults to JSONCodec
+	Codec drai.Codec
+}
+
+var _ drai.StorageBackend = (*Backend)(nil)
+
+// New returns a backend saving the states of one engine in the namespace
+func New(client redis.UniversalClient, namespace string) *Backend {
+	return &Backend{
+		Client:    client,
+		Namespace: namespace,
+	}
+}
+
+func (r *Backend) prefix() string {
+	return "drai:" + r.Namespace + ":"
+}
+
+func (r *Backend) codec() drai.Codec {
+	if r.Codec == nil {
+		return drai.JSONCodec{}
+	}
+
+	return r.Codec
+}
+
+func (r *Backend) indexKey() string {
+	return r.prefix() + "instances"
+}
+
+func (r *Backend) instanceKey(id string) string {
+	return r.prefix() + "instance:" + id
+}
+
+func (r *Backend) SaveApps(apps []*drai.SerializedAppState) error {
+	if r.Namespace == "" {
+		return ErrNoNamespace
+	}
+
+	ctx := context.Background()
+
+	oldIDs, err := r.Client.SMembers(ctx, r.indexKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	encoded := make([][]byte, len(apps))
+	for i, v := range apps {
+		encoded[i], err = drai.EncodeWithHeader(r.codec(), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range oldIDs {
+			pipe.Del(ctx, r.instanceKey(id))
+		}
+		pipe.Del(ctx, r.indexKey())
+
+		for i, v := range apps {
+			pipe.Set(ctx, r.instanceKey(v.ID), encoded[i], 0)
+			pipe.SAdd(ctx, r.indexKey(), v.ID)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (r *Backend) LoadApps() ([]*drai.SerializedAppState, error) {
+	if r.Namespace == "" {
+		return nil, ErrNoNamespace
+	}
+
+	ctx := context.Background()
+
+	ids, err := r.Client.SMembers(ctx, r.indexKey()).Result()
+	if err != nil || len(ids) < 1 {
+		return nil, err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.instanceKey(id)
+	}
+
+	values, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*drai.SerializedAppState, 0, len(values))
+	for i, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			// In the index but the key is gone
+			logrus.WithField("instance", ids[i]).Warn("Missing saved instance in redis")
+			continue
+		}
+
+		var decoded *drai.SerializedAppState
+		err = drai.DecodeWithHeader([]byte(str), &decoded)
+		if err != nil {
+			logrus.WithError(err).WithField("instance", ids[i]).Error("Failed decoding saved instance")
+			continue
+		}
+
+		result = append(result, decoded)
+	}
+
+	return result, nil
+}
+
+func (r *Backend) SaveInstance(state *drai.SerializedAppState) error {
+	if r.Namespace == "" {
+		return ErrNoNamespace
+	}
+
+	ctx := context.Background()
+
+	encoded, err := drai.EncodeWithHeader(r.codec(), state)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, r.instanceKey(state.ID), encoded, 0)
+		pipe.SAdd(ctx, r.indexKey(), state.ID)
+		return nil
+	})
+
+	return err
+}
+
+func (r *Backend) DeleteInstance(id string) error {
+	if r.Namespace == "" {
+		return ErrNoNamespace
+	}
+
+	ctx := context.Background()
+
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.instanceKey(id))
+		pipe.SRem(ctx, r.indexKey(), id)
+		return nil
+	})
+
+	return err
+}
+
+func (r *Backend) ListInstances() ([]string, error) {
+	if r.Namespace == "" {
+		return nil, ErrNoNamespace
+	}
+
+	return r.Client.SMembers(context.Background(), r.indexKey()).Result()
+}
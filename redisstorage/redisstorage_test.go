@@ -0,0 +1,187 @@
+package redisstorage
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jonas747/drai"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestBackend(t *testing.T, namespace string) (*Backend, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return New(client, namespace), mr
+}
+
+func testState(id string) *drai.SerializedAppState {
+	return &drai.SerializedAppState{
+		ID:        id,
+		AppID:     "test",
+		ChannelID: "c",
+		GuildID:   "g",
+		Actions: []*drai.Action{
+			{Emoji: drai.UnicodeEmoji("👍"), MessageID: "m"},
+		},
+		AppData:     json.RawMessage(`{"count":1}`),
+		Users:       []string{"u"},
+		IdleTimeout: time.Minute,
+		LastAction:  time.Unix(1000, 0).UTC(),
+	}
+}
+
+func listed(t *testing.T, b *Backend) []string {
+	ids, err := b.ListInstances()
+	if err != nil {
+		t.Fatal("ListInstances:", err)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSaveAndDeleteInstance(t *testing.T) {
+	b, _ := newTestBackend(t, "a")
+
+	if ids := listed(t, b); len(ids) != 0 {
+		t.Fatal("expected no instances, got", ids)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if err := b.SaveInstance(testState(id)); err != nil {
+			t.Fatal("SaveInstance:", err)
+		}
+	}
+
+	// Saving again replaces it
+	if err := b.SaveInstance(testState("1")); err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	if ids := listed(t, b); len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Fatal("expected instances 1 and 2, got", ids)
+	}
+
+	if err := b.DeleteInstance("1"); err != nil {
+		t.Fatal("DeleteInstance:", err)
+	}
+
+	// Deleting one that does not exist is not an error
+	if err := b.DeleteInstance("nope"); err != nil {
+		t.Fatal("DeleteInstance of missing instance:", err)
+	}
+
+	if ids := listed(t, b); len(ids) != 1 || ids[0] != "2" {
+		t.Fatal("expected instance 2, got", ids)
+	}
+}
+
+func TestSaveAppsReplaces(t *testing.T) {
+	b, mr := newTestBackend(t, "a")
+
+	if err := b.SaveApps([]*drai.SerializedAppState{testState("1"), testState("2")}); err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	if err := b.SaveApps([]*drai.SerializedAppState{testState("3")}); err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	if ids := listed(t, b); len(ids) != 1 || ids[0] != "3" {
+		t.Fatal("expected instance 3, got", ids)
+	}
+
+	if mr.Exists(b.instanceKey("1")) || mr.Exists(b.instanceKey("2")) {
+		t.Fatal("replaced instances are still saved")
+	}
+}
+
+func TestLoadApps(t *testing.T) {
+	b, _ := newTestBackend(t, "a")
+
+	saved := testState("1")
+	if err := b.SaveApps([]*drai.SerializedAppState{saved}); err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	loaded, err := b.LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if len(loaded) != 1 {
+		t.Fatal("expected 1 instance, got", len(loaded))
+	}
+
+	l := loaded[0]
+	if l.ID != saved.ID || l.AppID != saved.AppID || l.ChannelID != saved.ChannelID || l.GuildID != saved.GuildID {
+		t.Error("ids don't match:", l)
+	}
+
+	if string(l.AppData) != string(saved.AppData) {
+		t.Errorf("app data: got %s, expected %s", l.AppData, saved.AppData)
+	}
+
+	if len(l.Actions) != 1 || !l.Actions[0].Equal(saved.Actions[0]) {
+		t.Error("actions don't match:", l.Actions)
+	}
+
+	if len(l.Users) != 1 || l.Users[0] != "u" || l.IdleTimeout != saved.IdleTimeout || !l.LastAction.Equal(saved.LastAction) {
+		t.Error("instance fields don't match:", l)
+	}
+}
+
+func TestLoadAppsCodec(t *testing.T) {
+	b, _ := newTestBackend(t, "a")
+	b.Codec = drai.GzipCodec{Codec: drai.MsgpackCodec{}}
+
+	if err := b.SaveInstance(testState("1")); err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	// Read with the codec named in the header, not the configured one
+	b.Codec = nil
+	loaded, err := b.LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if len(loaded) != 1 || loaded[0].ID != "1" || string(loaded[0].AppData) != `{"count":1}` {
+		t.Fatal("unexpected state loaded:", loaded)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	a, mr := newTestBackend(t, "a")
+	b := New(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "b")
+
+	if err := a.SaveInstance(testState("1")); err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	// A engine replacing its own saves must not touch the other's
+	if err := b.SaveApps([]*drai.SerializedAppState{testState("2")}); err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	if ids := listed(t, a); len(ids) != 1 || ids[0] != "1" {
+		t.Fatal("expected instance 1 in namespace a, got", ids)
+	}
+
+	if ids := listed(t, b); len(ids) != 1 || ids[0] != "2" {
+		t.Fatal("expected instance 2 in namespace b, got", ids)
+	}
+
+	none := New(a.Client, "")
+	if _, err := none.ListInstances(); err != ErrNoNamespace {
+		t.Fatal("expected ErrNoNamespace, got", err)
+	}
+
+	if err := none.SaveApps(nil); err != ErrNoNamespace {
+		t.Fatal("expected ErrNoNamespace, got", err)
+	}
+}
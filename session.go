@@ -0,0 +1,25 @@
+package drai
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Session is the part of the discord api used by the engine and apps
+// *discordgo.Session implements it, use FakeSession to test apps without a connection to discord
+type Session interface {
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageEdit(channelID, messageID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageEditComplex(m *discordgo.MessageEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error
+
+	MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error
+	MessageReactionRemove(channelID, messageID, emojiID, userID string, options ...discordgo.RequestOption) error
+	MessageReactionsRemoveAll(channelID, messageID string, options ...discordgo.RequestOption) error
+
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+	UserChannelPermissions(userID, channelID string, options ...discordgo.RequestOption) (int64, error)
+
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+}
+
+var _ Session = (*discordgo.Session)(nil)
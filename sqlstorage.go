@@ -0,0 +1,615 @@
+package drai
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SQLDialect int
+
+const (
+	SQLDialectSQLite SQLDialect = iota
+	SQLDialectPostgres
+)
+
+// SQLStorageBackend saves application states to a sql database, with the instances, their actions, their whitelisted users
+// and the app data in seperate tables so they can be inspected and cleaned up with plain sql
+//
+// The schema is created and upgraded automatically on first use, or by calling Migrate
+// Works with sqlite and postgres, the driver has to be imported by the user
+//
+// Every engine sharing a database needs its own Namespace: a engine treats everything saved in its namespace as its own,
+// so checkpoints delete the instances it isn't running and StopAndSaveStates replaces all of them.
+// Use something that stays the same across restarts (such as a shard or container name), so the engine restores its own instances
+type SQLStorageBackend struct {
+	DB      *sql.DB
+	Dialect SQLDialect
+
+	// Required, stored in the namespace column of every table
+	Namespace string
+
+	migrateMU sync.Mutex
+	migrated  bool
+}
+
+var _ StorageBackend = (*SQLStorageBackend)(nil)
+
+var (
+	ErrNoSQLNamespace = errors.New("No namespace set on the sql storage backend")
+)
+
+// The tables holding the saved states, all with a namespace column
+var sqlTables = []string{"drai_instances", "drai_actions", "drai_users", "drai_app_data"}
+
+// The schema version that added namespaces
+const sqlNamespaceVersion = 4
+
+// Key of the postgres advisory lock held while migrating
+const sqlMigrateLockKey = 4727123911
+
+// sqlMigrations are the schema versions in order, a migration is never changed once released, add a new one instead
+var sqlMigrations = [][]string{
+	// Version 1
+	{
+		`CREATE TABLE drai_instances (
+			id TEXT PRIMARY KEY,
+			app_id TEXT NOT NULL,
+			channel_id TEXT NOT NULL,
+			guild_id TEXT NOT NULL,
+			allow_all_users BOOLEAN NOT NULL,
+			access TEXT,
+			idle_timeout BIGINT NOT NULL,
+			idle_warning BIGINT NOT NULL,
+			last_action BIGINT NOT NULL
+		)`,
+		`CREATE INDEX drai_instances_channel_idx ON drai_instances (channel_id)`,
+		`CREATE TABLE drai_actions (
+			instance_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			message_id TEXT NOT NULL,
+			emoji_name TEXT NOT NULL,
+			emoji_id TEXT NOT NULL,
+			emoji_animated BOOLEAN NOT NULL,
+			name TEXT NOT NULL,
+			remove_on_success BOOLEAN NOT NULL,
+			remove_not_whitelisted BOOLEAN NOT NULL,
+			access TEXT,
+			user_data TEXT,
+			PRIMARY KEY (instance_id, position)
+		)`,
+		`CREATE TABLE drai_users (
+			instance_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (instance_id, position)
+		)`,
+		`CREATE TABLE drai_app_data (
+			instance_id TEXT PRIMARY KEY,
+			data TEXT NOT NULL
+		)`,
+	},
+	// Version 2
+	{
+		`ALTER TABLE drai_instances ADD COLUMN app_version INTEGER NOT NULL DEFAULT 0`,
+	},
+	// Version 3
+	{
+		`ALTER TABLE drai_instances ADD COLUMN transport INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE drai_actions ADD COLUMN label TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE drai_actions ADD COLUMN button_style INTEGER NOT NULL DEFAULT 0`,
+	},
+	// Version 4, namespaces, the tables are recreated since sqlite can't change primary keys
+	{
+		`CREATE TABLE drai_instances_v4 (
+			namespace TEXT NOT NULL,
+			id TEXT NOT NULL,
+			app_id TEXT NOT NULL,
+			app_version INTEGER NOT NULL DEFAULT 0,
+			channel_id TEXT NOT NULL,
+			guild_id TEXT NOT NULL,
+			allow_all_users BOOLEAN NOT NULL,
+			access TEXT,
+			transport INTEGER NOT NULL DEFAULT 0,
+			idle_timeout BIGINT NOT NULL,
+			idle_warning BIGINT NOT NULL,
+			last_action BIGINT NOT NULL,
+			PRIMARY KEY (namespace, id)
+		)`,
+		`INSERT INTO drai_instances_v4 (namespace, id, app_id, app_version, channel_id, guild_id, allow_all_users, access, transport, idle_timeout, idle_warning, last_action)
+			SELECT '', id, app_id, app_version, channel_id, guild_id, allow_all_users, access, transport, idle_timeout, idle_warning, last_action FROM drai_instances`,
+		`DROP TABLE drai_instances`,
+		`ALTER TABLE drai_instances_v4 RENAME TO drai_instances`,
+		`CREATE INDEX drai_instances_channel_idx ON drai_instances (channel_id)`,
+
+		`CREATE TABLE drai_actions_v4 (
+			namespace TEXT NOT NULL,
+			instance_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			message_id TEXT NOT NULL,
+			emoji_name TEXT NOT NULL,
+			emoji_id TEXT NOT NULL,
+			emoji_animated BOOLEAN NOT NULL,
+			name TEXT NOT NULL,
+			remove_on_success BOOLEAN NOT NULL,
+			remove_not_whitelisted BOOLEAN NOT NULL,
+			access TEXT,
+			user_data TEXT,
+			label TEXT NOT NULL DEFAULT '',
+			button_style INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (namespace, instance_id, position)
+		)`,
+		`INSERT INTO drai_actions_v4 (namespace, instance_id, position, message_id, emoji_name, emoji_id, emoji_animated, name, remove_on_success, remove_not_whitelisted, access, user_data, label, button_style)
+			SELECT '', instance_id, position, message_id, emoji_name, emoji_id, emoji_animated, name, remove_on_success, remove_not_whitelisted, access, user_data, label, button_style FROM drai_actions`,
+		`DROP TABLE drai_actions`,
+		`ALTER TABLE drai_actions_v4 RENAME TO drai_actions`,
+
+		`CREATE TABLE drai_users_v4 (
+			namespace TEXT NOT NULL,
+			instance_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			PRIMARY KEY (namespace, instance_id, position)
+		)`,
+		`INSERT INTO drai_users_v4 (namespace, instance_id, position, user_id) SELECT '', instance_id, position, user_id FROM drai_users`,
+		`DROP TABLE drai_users`,
+		`ALTER TABLE drai_users_v4 RENAME TO drai_users`,
+
+		`CREATE TABLE drai_app_data_v4 (
+			namespace TEXT NOT NULL,
+			instance_id TEXT NOT NULL,
+			data TEXT NOT NULL,
+			PRIMARY KEY (namespace, instance_id)
+		)`,
+		`INSERT INTO drai_app_data_v4 (namespace, instance_id, data) SELECT '', instance_id, data FROM drai_app_data`,
+		`DROP TABLE drai_app_data`,
+		`ALTER TABLE drai_app_data_v4 RENAME TO drai_app_data`,
+	},
+}
+
+// Migrate creates the tables or upgrades them to the latest schema version
+// On postgres concurrent migrations from multiple processes wait for each other,
+// with sqlite they must not run concurrently (the loser fails with a busy error) so start one process first
+func (s *SQLStorageBackend) Migrate() error {
+	if s.Namespace == "" {
+		return ErrNoSQLNamespace
+	}
+
+	s.migrateMU.Lock()
+	defer s.migrateMU.Unlock()
+
+	if s.migrated {
+		return nil
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.Dialect == SQLDialectPostgres {
+		// Held until the transaction ends, so the others read the version after we're done
+		_, err = tx.Exec(s.rebind(`SELECT pg_advisory_xact_lock(?)`), int64(sqlMigrateLockKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS drai_schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM drai_schema_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		for _, stmt := range sqlMigrations[i] {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(s.rebind(`INSERT INTO drai_schema_version (version) VALUES (?)`), i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version > 0 && version < sqlNamespaceVersion {
+		// Saved before there were namespaces, these belong to the engine upgrading the schema
+		for _, table := range sqlTables {
+			_, err = tx.Exec(s.rebind(`UPDATE `+table+` SET namespace = ? WHERE namespace = ''`), s.Namespace)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	s.migrated = true
+	return nil
+}
+
+// rebind replaces the ? placeholders in the query with the ones used by the dialect
+func (s *SQLStorageBackend) rebind(query string) string {
+	if s.Dialect != SQLDialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func (s *SQLStorageBackend) SaveApps(apps []*SerializedAppState) error {
+	err := s.Migrate()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range sqlTables {
+		_, err = tx.Exec(s.rebind(`DELETE FROM `+table+` WHERE namespace = ?`), s.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range apps {
+		err = s.insertState(tx, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStorageBackend) SaveInstance(state *SerializedAppState) error {
+	err := s.Migrate()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.deleteState(tx, state.ID)
+	if err != nil {
+		return err
+	}
+
+	err = s.insertState(tx, state)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStorageBackend) DeleteInstance(id string) error {
+	err := s.Migrate()
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = s.deleteState(tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStorageBackend) ListInstances() ([]string, error) {
+	err := s.Migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Query(s.rebind(`SELECT id FROM drai_instances WHERE namespace = ? ORDER BY id`), s.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *SQLStorageBackend) LoadApps() ([]*SerializedAppState, error) {
+	err := s.Migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	states, byID, err := s.loadInstances(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.loadActions(tx, byID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.loadUsers(tx, byID)
+	if err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// deleteState deletes all rows belonging to the instance
+func (s *SQLStorageBackend) deleteState(tx *sql.Tx, id string) error {
+	queries := []string{
+		`DELETE FROM drai_instances WHERE namespace = ? AND id = ?`,
+		`DELETE FROM drai_actions WHERE namespace = ? AND instance_id = ?`,
+		`DELETE FROM drai_users WHERE namespace = ? AND instance_id = ?`,
+		`DELETE FROM drai_app_data WHERE namespace = ? AND instance_id = ?`,
+	}
+
+	for _, q := range queries {
+		_, err := tx.Exec(s.rebind(q), s.Namespace, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertState inserts the state's rows, any previous rows for the instance has to be deleted first
+func (s *SQLStorageBackend) insertState(tx *sql.Tx, state *SerializedAppState) error {
+	access, err := encodeNullJSON(state.Access)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.rebind(`INSERT INTO drai_instances
+		(namespace, id, app_id, app_version, channel_id, guild_id, allow_all_users, access, transport, idle_timeout, idle_warning, last_action)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		s.Namespace, state.ID, state.AppID, state.AppVersion, state.ChannelID, state.GuildID, state.AllowAllUsers, access, int(state.Transport),
+		int64(state.IdleTimeout), int64(state.IdleWarning), timeToUnixNano(state.LastAction))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.rebind(`INSERT INTO drai_app_data (namespace, instance_id, data) VALUES (?, ?, ?)`), s.Namespace, state.ID, string(state.AppData))
+	if err != nil {
+		return err
+	}
+
+	for i, a := range state.Actions {
+		actionAccess, err := encodeNullJSON(a.Access)
+		if err != nil {
+			return err
+		}
+
+		userData, err := encodeNullJSON(a.UserData)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(s.rebind(`INSERT INTO drai_actions
+			(namespace, instance_id, position, message_id, emoji_name, emoji_id, emoji_animated, name, remove_on_success, remove_not_whitelisted, access, user_data, label, button_style)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			s.Namespace, state.ID, i, a.MessageID, a.Emoji.Name, a.Emoji.ID, a.Emoji.Animated, a.Name,
+			a.RemoveReactionOnSuccess, a.RemoveReactionNotWhitelisted, actionAccess, userData, a.Label, int(a.ButtonStyle))
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, u := range state.Users {
+		_, err = tx.Exec(s.rebind(`INSERT INTO drai_users (namespace, instance_id, position, user_id) VALUES (?, ?, ?, ?)`), s.Namespace, state.ID, i, u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStorageBackend) loadInstances(tx *sql.Tx) ([]*SerializedAppState, map[string]*SerializedAppState, error) {
+	rows, err := tx.Query(s.rebind(`SELECT i.id, i.app_id, i.app_version, i.channel_id, i.guild_id, i.allow_all_users, i.access, i.transport,
+		i.idle_timeout, i.idle_warning, i.last_action, d.data
+		FROM drai_instances i LEFT JOIN drai_app_data d ON d.namespace = i.namespace AND d.instance_id = i.id
+		WHERE i.namespace = ?
+		ORDER BY i.id`), s.Namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	states := make([]*SerializedAppState, 0)
+	byID := make(map[string]*SerializedAppState)
+	for rows.Next() {
+		var state SerializedAppState
+		var access, data sql.NullString
+		var transport int
+		var idleTimeout, idleWarning, lastAction int64
+
+		err = rows.Scan(&state.ID, &state.AppID, &state.AppVersion, &state.ChannelID, &state.GuildID, &state.AllowAllUsers, &access, &transport,
+			&idleTimeout, &idleWarning, &lastAction, &data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = decodeNullJSON(access, &state.Access)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		state.Transport = Transport(transport)
+		state.IdleTimeout = time.Duration(idleTimeout)
+		state.IdleWarning = time.Duration(idleWarning)
+		state.LastAction = unixNanoToTime(lastAction)
+		if data.Valid {
+			state.AppData = json.RawMessage(data.String)
+		}
+
+		states = append(states, &state)
+		byID[state.ID] = &state
+	}
+
+	return states, byID, rows.Err()
+}
+
+func (s *SQLStorageBackend) loadActions(tx *sql.Tx, byID map[string]*SerializedAppState) error {
+	rows, err := tx.Query(s.rebind(`SELECT instance_id, message_id, emoji_name, emoji_id, emoji_animated, name,
+		remove_on_success, remove_not_whitelisted, access, user_data, label, button_style
+		FROM drai_actions WHERE namespace = ? ORDER BY instance_id, position`), s.Namespace)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instanceID string
+		var action Action
+		var access, userData sql.NullString
+		var buttonStyle int
+
+		err = rows.Scan(&instanceID, &action.MessageID, &action.Emoji.Name, &action.Emoji.ID, &action.Emoji.Animated, &action.Name,
+			&action.RemoveReactionOnSuccess, &action.RemoveReactionNotWhitelisted, &access, &userData, &action.Label, &buttonStyle)
+		if err != nil {
+			return err
+		}
+		action.ButtonStyle = discordgo.ButtonStyle(buttonStyle)
+
+		err = decodeNullJSON(access, &action.Access)
+		if err != nil {
+			return err
+		}
+
+		err = decodeNullJSON(userData, &action.UserData)
+		if err != nil {
+			return err
+		}
+
+		// Rows left behind by a instance that has been deleted by hand
+		if state, ok := byID[instanceID]; ok {
+			state.Actions = append(state.Actions, &action)
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *SQLStorageBackend) loadUsers(tx *sql.Tx, byID map[string]*SerializedAppState) error {
+	rows, err := tx.Query(s.rebind(`SELECT instance_id, user_id FROM drai_users WHERE namespace = ? ORDER BY instance_id, position`), s.Namespace)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instanceID, userID string
+		err = rows.Scan(&instanceID, &userID)
+		if err != nil {
+			return err
+		}
+
+		if state, ok := byID[instanceID]; ok {
+			state.Users = append(state.Users, userID)
+		}
+	}
+
+	return rows.Err()
+}
+
+// encodeNullJSON encodes v as json, nil pointers are stored as NULL
+func encodeNullJSON(v interface{}) (sql.NullString, error) {
+	if r, ok := v.(*AccessRules); ok && r == nil {
+		return sql.NullString{}, nil
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+func decodeNullJSON(s sql.NullString, dst interface{}) error {
+	if !s.Valid {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(s.String), dst)
+}
+
+// timeToUnixNano returns 0 for the zero time, which is out of range for UnixNano
+func timeToUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func unixNanoToTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
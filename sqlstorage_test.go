@@ -0,0 +1,308 @@
+package drai
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/glebarez/go-sqlite"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Pure go sqlite, so the tests don't need cgo
+const sqlTestDriver = "sqlite"
+
+func openSQLTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open(sqlTestDriver, filepath.Join(t.TempDir(), "drai.db"))
+	if err != nil {
+		t.Fatal("Failed opening database:", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func sqlSchemaVersion(t *testing.T, db *sql.DB) (version, rows int) {
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0), COUNT(*) FROM drai_schema_version`).Scan(&version, &rows)
+	if err != nil {
+		t.Fatal("Failed reading schema version:", err)
+	}
+
+	return
+}
+
+func sqlTestState(id string) *SerializedAppState {
+	ud := UserData{}
+	ud.Set("index", 3)
+
+	return &SerializedAppState{
+		ID:         id,
+		AppID:      "test",
+		AppVersion: 2,
+		ChannelID:  "c",
+		GuildID:    "g",
+		Actions: []*Action{
+			{
+				UserData:                ud,
+				Emoji:                   UnicodeEmoji("👍"),
+				MessageID:               "m1",
+				Name:                    "move",
+				RemoveReactionOnSuccess: true,
+				Label:                   "Up",
+				ButtonStyle:             discordgo.SuccessButton,
+			},
+			{
+				Emoji:     CustomEmoji("blob", "123", true),
+				MessageID: "m2",
+				Access:    &AccessRules{DenyUsers: []string{"d"}},
+			},
+		},
+		AppData:     json.RawMessage(`{"count":1}`),
+		Users:       []string{"u2", "u1"},
+		Access:      &AccessRules{AllowRoles: []string{"r"}},
+		Transport:   TransportButtons,
+		IdleTimeout: time.Minute,
+		IdleWarning: time.Second * 30,
+		LastAction:  time.Unix(1000, 5),
+	}
+}
+
+func TestSQLMigrate(t *testing.T) {
+	db := openSQLTestDB(t)
+
+	err := (&SQLStorageBackend{DB: db, Namespace: "a"}).Migrate()
+	if err != nil {
+		t.Fatal("Migrate:", err)
+	}
+
+	version, rows := sqlSchemaVersion(t, db)
+	if version != len(sqlMigrations) || rows != len(sqlMigrations) {
+		t.Fatalf("Expected version %d with %d rows, got %d with %d rows", len(sqlMigrations), len(sqlMigrations), version, rows)
+	}
+
+	// Running it again on the existing schema, as a new process would, does nothing
+	err = (&SQLStorageBackend{DB: db, Namespace: "a"}).Migrate()
+	if err != nil {
+		t.Fatal("Migrate on existing schema:", err)
+	}
+
+	version, rows = sqlSchemaVersion(t, db)
+	if version != len(sqlMigrations) || rows != len(sqlMigrations) {
+		t.Fatalf("Expected version %d with %d rows after migrating again, got %d with %d rows", len(sqlMigrations), len(sqlMigrations), version, rows)
+	}
+}
+
+func TestSQLMigrateUpgrade(t *testing.T) {
+	db := openSQLTestDB(t)
+
+	// A database created by the first version
+	statements := append([]string{`CREATE TABLE drai_schema_version (version INTEGER NOT NULL)`, `INSERT INTO drai_schema_version (version) VALUES (1)`}, sqlMigrations[0]...)
+	statements = append(statements, `INSERT INTO drai_instances (id, app_id, channel_id, guild_id, allow_all_users, idle_timeout, idle_warning, last_action) VALUES ('old', 'test', 'c', 'g', 1, 0, 0, 0)`)
+	for _, stmt := range statements {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			t.Fatal("Failed creating old schema:", err)
+		}
+	}
+
+	b := &SQLStorageBackend{DB: db, Namespace: "a"}
+	loaded, err := b.LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps after upgrading:", err)
+	}
+
+	version, _ := sqlSchemaVersion(t, db)
+	if version != len(sqlMigrations) {
+		t.Fatalf("Expected version %d after upgrading, got %d", len(sqlMigrations), version)
+	}
+
+	if len(loaded) != 1 || loaded[0].ID != "old" || loaded[0].AppVersion != 0 || loaded[0].Transport != TransportReactions || !loaded[0].AllowAllUsers {
+		t.Fatalf("Unexpected instance loaded from the old schema: %#v", loaded)
+	}
+
+	// Saved before namespaces, so it went to the engine that upgraded the schema
+	ids, err := (&SQLStorageBackend{DB: db, Namespace: "b"}).ListInstances()
+	if err != nil || len(ids) != 0 {
+		t.Fatal("Expected no instances in another namespace, got", ids, err)
+	}
+}
+
+func TestSQLStorage(t *testing.T) {
+	db := openSQLTestDB(t)
+	b := &SQLStorageBackend{DB: db, Namespace: "a"}
+
+	saved := sqlTestState("1")
+	for _, v := range []*SerializedAppState{saved, sqlTestState("2")} {
+		err := b.SaveInstance(v)
+		if err != nil {
+			t.Fatal("SaveInstance:", err)
+		}
+	}
+
+	// Saving again replaces it
+	saved.Users = []string{"u3"}
+	err := b.SaveInstance(saved)
+	if err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	ids, err := b.ListInstances()
+	sort.Strings(ids)
+	if err != nil || len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Fatal("Expected instances 1 and 2, got", ids, err)
+	}
+
+	err = b.DeleteInstance("2")
+	if err != nil {
+		t.Fatal("DeleteInstance:", err)
+	}
+
+	// Deleting one that does not exist is not an error
+	err = b.DeleteInstance("nope")
+	if err != nil {
+		t.Fatal("DeleteInstance of missing instance:", err)
+	}
+
+	// Loaded by a new backend, as after a restart
+	loaded, err := (&SQLStorageBackend{DB: db, Namespace: "a"}).LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if len(loaded) != 1 {
+		t.Fatal("Expected 1 instance, got", len(loaded))
+	}
+
+	l := loaded[0]
+	if l.ID != "1" || l.AppID != "test" || l.AppVersion != 2 || l.ChannelID != "c" || l.GuildID != "g" || l.Transport != TransportButtons {
+		t.Errorf("Instance fields don't match: %#v", l)
+	}
+
+	if l.IdleTimeout != time.Minute || l.IdleWarning != time.Second*30 || !l.LastAction.Equal(saved.LastAction) {
+		t.Errorf("Times don't match: %#v", l)
+	}
+
+	if string(l.AppData) != `{"count":1}` {
+		t.Errorf("App data: got %s", l.AppData)
+	}
+
+	if len(l.Users) != 1 || l.Users[0] != "u3" {
+		t.Error("Users:", l.Users)
+	}
+
+	if l.Access == nil || len(l.Access.AllowRoles) != 1 || l.Access.AllowRoles[0] != "r" {
+		t.Errorf("Access: %#v", l.Access)
+	}
+
+	if len(l.Actions) != 2 {
+		t.Fatal("Expected 2 actions, got", len(l.Actions))
+	}
+
+	a := l.Actions[0]
+	index, _ := a.Int("index")
+	if !a.Equal(saved.Actions[0]) || a.Name != "move" || !a.RemoveReactionOnSuccess || a.Label != "Up" || a.ButtonStyle != discordgo.SuccessButton || index != 3 {
+		t.Errorf("First action doesn't match: %#v", a)
+	}
+
+	a = l.Actions[1]
+	if !a.Equal(saved.Actions[1]) || !a.Emoji.Animated || a.Access == nil || len(a.Access.DenyUsers) != 1 {
+		t.Errorf("Second action doesn't match: %#v", a)
+	}
+}
+
+func TestSQLSaveAppsReplaces(t *testing.T) {
+	b := &SQLStorageBackend{DB: openSQLTestDB(t), Namespace: "a"}
+
+	err := b.SaveApps([]*SerializedAppState{sqlTestState("1"), sqlTestState("2")})
+	if err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	err = b.SaveApps([]*SerializedAppState{sqlTestState("3")})
+	if err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	loaded, err := b.LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if len(loaded) != 1 || loaded[0].ID != "3" || len(loaded[0].Actions) != 2 {
+		t.Fatalf("Expected only instance 3, got %#v", loaded)
+	}
+}
+
+func TestSQLNamespaces(t *testing.T) {
+	db := openSQLTestDB(t)
+	a := &SQLStorageBackend{DB: db, Namespace: "a"}
+	b := &SQLStorageBackend{DB: db, Namespace: "b"}
+
+	// The same instance id in both, which the keys have to allow
+	err := a.SaveApps([]*SerializedAppState{sqlTestState("1"), sqlTestState("2")})
+	if err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	other := sqlTestState("1")
+	other.Actions = other.Actions[:1]
+	other.Users = []string{"b1"}
+	other.AppData = json.RawMessage(`{"count":2}`)
+	err = b.SaveInstance(other)
+	if err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	// A engine replacing or deleting its own saves must not touch the other's
+	err = b.SaveApps([]*SerializedAppState{other, sqlTestState("3")})
+	if err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	err = b.DeleteInstance("3")
+	if err != nil {
+		t.Fatal("DeleteInstance:", err)
+	}
+
+	err = a.DeleteInstance("2")
+	if err != nil {
+		t.Fatal("DeleteInstance:", err)
+	}
+
+	for _, tc := range []struct {
+		backend *SQLStorageBackend
+		actions int
+		users   []string
+		data    string
+	}{
+		{a, 2, []string{"u2", "u1"}, `{"count":1}`},
+		{b, 1, []string{"b1"}, `{"count":2}`},
+	} {
+		ids, err := tc.backend.ListInstances()
+		if err != nil || len(ids) != 1 || ids[0] != "1" {
+			t.Fatal("Expected instance 1 in namespace", tc.backend.Namespace, "got", ids, err)
+		}
+
+		loaded, err := tc.backend.LoadApps()
+		if err != nil || len(loaded) != 1 {
+			t.Fatal("Expected 1 instance loaded in namespace", tc.backend.Namespace, "got", len(loaded), err)
+		}
+
+		l := loaded[0]
+		if len(l.Actions) != tc.actions || !equalStrings(l.Users, tc.users) || string(l.AppData) != tc.data {
+			t.Errorf("Namespace %s loaded another namespace's rows: %#v", tc.backend.Namespace, l)
+		}
+	}
+
+	// Required
+	none := &SQLStorageBackend{DB: db}
+	if _, err := none.ListInstances(); err != ErrNoSQLNamespace {
+		t.Fatal("Expected ErrNoSQLNamespace, got", err)
+	}
+
+	if err := none.SaveApps(nil); err != ErrNoSQLNamespace {
+		t.Fatal("Expected ErrNoSQLNamespace, got", err)
+	}
+}
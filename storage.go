@@ -2,151 +2,480 @@ package drai
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/Sirupsen/logrus"
-	"github.com/bwmarrin/discordgo"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"sync"
 	"time"
 )
 
 var (
 	RegisteredApps        = make(map[string]reflect.Type)
 	InverseRegisteredApps = make(map[reflect.Type]string)
+
+	// The migrations of each registered app, the app's current state version is len(migrations)+1
+	registeredMigrations = make(map[string][]StateMigration)
 )
 
+// StateMigration upgrades the serialized state of a app by one version
+type StateMigration func(data []byte) ([]byte, error)
+
 // Registers an app, this is needed for deserialization of the app's state
-func RegisterApp(id string, app App) {
+// version is the current version of the app's serialized state, starting at 1, bump it whenever the format changes
+// and add a migration upgrading the previous version, migrations[0] upgrades version 1 to 2, migrations[1] 2 to 3 and so on
+func RegisterApp(id string, app App, version int, migrations ...StateMigration) {
+	if version < 1 || len(migrations) != version-1 {
+		panic("drai: app " + id + " has version " + strconv.Itoa(version) + " but " + strconv.Itoa(len(migrations)) + " migrations, expected version-1")
+	}
+
+	if binder, ok := app.(appBinder); ok {
+		err := binder.validateApp(app)
+		if err != nil {
+			panic("drai: app " + id + ": " + err.Error())
+		}
+	}
+
 	v := reflect.Indirect(reflect.ValueOf(app))
 	t := v.Type()
 	RegisteredApps[id] = t
 	InverseRegisteredApps[t] = id
+	registeredMigrations[id] = migrations
+}
+
+// appVersion returns the current state version of the registered app
+func appVersion(id string) int {
+	return len(registeredMigrations[id]) + 1
+}
+
+// migrateState upgrades data from the version it was saved with to the app's current version
+func migrateState(appID string, version int, data []byte) ([]byte, error) {
+	// Saved before states were versioned
+	if version == 0 {
+		version = 1
+	}
+
+	migrations := registeredMigrations[appID]
+	if version > len(migrations)+1 {
+		return nil, errors.New("State of " + appID + " was saved with version " + strconv.Itoa(version) + ", newer than the current version " + strconv.Itoa(len(migrations)+1))
+	}
+
+	for i := version - 1; i < len(migrations); i++ {
+		var err error
+		data, err = migrations[i](data)
+		if err != nil {
+			return nil, errors.New("Failed migrating state of " + appID + " to version " + strconv.Itoa(i+2) + ": " + err.Error())
+		}
+	}
+
+	return data, nil
+}
+
+// registeredAppID returns the id the app's type was registered with
+func registeredAppID(app App) (string, bool) {
+	t := reflect.Indirect(reflect.ValueOf(app)).Type()
+	id, ok := InverseRegisteredApps[t]
+	return id, ok
 }
 
 type StorageBackend interface {
-	// Saves all application states
-	SaveApps(apps []*Instance) error
+	// Saves all application states, replacing any previously saved ones
+	SaveApps(apps []*SerializedAppState) error
 
 	// Loads all application states
-	LoadApps(engine *Engine, session *discordgo.Session) ([]*Instance, error)
+	LoadApps() ([]*SerializedAppState, error)
+
+	// Saves a single application state, replacing the one previously saved with the same ID
+	SaveInstance(state *SerializedAppState) error
+
+	// Deletes a single application state, deleting one that does not exist is not an error
+	DeleteInstance(id string) error
+
+	// Returns the ID's of all saved application states
+	ListInstances() ([]string, error)
 }
 
+// FSStorageBackend saves all application states to a single file
 type FSStorageBackend struct {
 	Path string
+
+	// The codec new files are written with, defaults to JSONCodec
+	// Files are read with the codec they were written with regardless of this
+	Codec Codec
+
+	mu sync.Mutex
+	// The states currently in the file, nil if not read yet
+	states []*SerializedAppState
+	// Set if the file is corrupt and the states were loaded from the backup, so it's not rotated over the good backup
+	primaryCorrupt bool
 }
 
 type SerializedAppState struct {
+	ID            string          `json:"id"`
 	AppID         string          `json:"app_id"`
+	AppVersion    int             `json:"app_version,omitempty"`
 	ChannelID     string          `json:"channel_id"`
 	GuildID       string          `json:"guild_id"`
 	Actions       []*Action       `json:"actions"`
 	AppData       json.RawMessage `json:"app_data"`
 	AllowAllUsers bool            `json:"allow_all_users"`
 	Users         []string        `json:"userids"`
+	Access        *AccessRules    `json:"access,omitempty"`
+	Transport     Transport       `json:"transport,omitempty"`
 	IdleTimeout   time.Duration   `json:"idle_timeout"`
+	IdleWarning   time.Duration   `json:"idle_warning"`
 	LastAction    time.Time       `json:"last_action"`
 }
 
-func (f *FSStorageBackend) SaveApps(apps []*Instance) error {
-	outFile, err := os.Create(f.Path)
+// serializeInstance serializes the instance's app and state, the instance has to be locked
+// The returned state does not share any mutable data with the instance, so it can be used after unlocking
+func serializeInstance(inst *Instance) (*SerializedAppState, error) {
+	id, ok := registeredAppID(inst.App)
+	if !ok {
+		return nil, errors.New("Unknown app: " + reflect.Indirect(reflect.ValueOf(inst.App)).Type().Name())
+	}
+
+	serialized, err := inst.App.SerializeState()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	serializedApps := make([]*SerializedAppState, 0, len(apps))
-	for _, v := range apps {
-		v.Lock()
+	return &SerializedAppState{
+		ID:            inst.ID,
+		AppID:         id,
+		AppVersion:    appVersion(id),
+		ChannelID:     inst.ChannelID,
+		GuildID:       inst.GuildID,
+		Actions:       copyActions(inst.Actions),
+		AppData:       serialized,
+		AllowAllUsers: inst.AllowAllUsers,
+		Users:         append([]string(nil), inst.UserIDs...),
+		Access:        inst.Access.copy(),
+		Transport:     inst.Transport,
+		IdleTimeout:   inst.IdleTimeout,
+		IdleWarning:   inst.IdleWarning,
+		LastAction:    inst.LastAction,
+	}, nil
+}
 
-		t := reflect.Indirect(reflect.ValueOf(v.App)).Type()
+// restoreInstance creates a instance from a serialized state, loading the app's state
+func restoreInstance(engine *Engine, session Session, sas *SerializedAppState) (*Instance, error) {
+	t, ok := RegisteredApps[sas.AppID]
+	if !ok {
+		return nil, errors.New("Unknown app id: " + sas.AppID)
+	}
 
-		id, ok := InverseRegisteredApps[t]
-		if !ok {
-			logrus.WithField("app_name", t.Name()).Warn("Unknown app")
-			continue
-		}
+	// States saved before instances had ids
+	if sas.ID == "" {
+		sas.ID = engine.newInstanceID()
+	}
 
-		serialized, err := v.App.SerializeState()
-		if err != nil {
-			logrus.WithError(err).Error("Failed serializing app")
-			continue
-		}
+	appDecoded := reflect.New(t).Interface().(App)
+	// The state is kept around as the last saved state, so don't share anything mutable with it
+	instance := &Instance{
+		ID:            sas.ID,
+		ChannelID:     sas.ChannelID,
+		GuildID:       sas.GuildID,
+		Actions:       copyActions(sas.Actions),
+		Session:       session,
+		Engine:        engine,
+		UserIDs:       append([]string(nil), sas.Users...),
+		Access:        sas.Access.copy(),
+		Transport:     sas.Transport,
+		AllowAllUsers: sas.AllowAllUsers,
+		IdleTimeout:   sas.IdleTimeout,
+		IdleWarning:   sas.IdleWarning,
+		LastAction:    sas.LastAction,
 
-		serializedApps = append(serializedApps, &SerializedAppState{
-			AppID:         id,
-			ChannelID:     v.ChannelID,
-			GuildID:       v.GuildID,
-			Actions:       v.Actions,
-			AppData:       serialized,
-			AllowAllUsers: v.AllowAllUsers,
-			Users:         v.UserIDs,
-			IdleTimeout:   v.IdleTimeout,
-			LastAction:    v.LastAction,
-		})
+		App: appDecoded,
+	}
 
-		v.Session.ChannelMessageSend(v.ChannelID, "Engine is being shut down.\nApps running in this channel will be saved and started again once the engine is running.")
-		v.Unlock()
+	err := bindApp(appDecoded)
+	if err != nil {
+		return nil, err
 	}
 
-	allEncoded, err := json.Marshal(serializedApps)
+	appData, err := migrateState(sas.AppID, sas.AppVersion, sas.AppData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appDecoded.LoadState(instance, appData)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.saved = sas
+	// Save it again in the current version
+	if sas.AppVersion != appVersion(sas.AppID) {
+		instance.dirty = true
+	}
+
+	return instance, nil
+}
+
+func (f *FSStorageBackend) SaveApps(apps []*SerializedAppState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.write(apps)
+}
+
+func (f *FSStorageBackend) LoadApps() ([]*SerializedAppState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.read()
+	return f.states, err
+}
+
+func (f *FSStorageBackend) SaveInstance(state *SerializedAppState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.ensureRead()
 	if err != nil {
 		return err
 	}
 
-	_, err = outFile.Write(allEncoded)
-	outFile.Close()
-	return err
+	newStates := make([]*SerializedAppState, 0, len(f.states)+1)
+	replaced := false
+	for _, v := range f.states {
+		if v.ID == state.ID {
+			v = state
+			replaced = true
+		}
+
+		newStates = append(newStates, v)
+	}
+
+	if !replaced {
+		newStates = append(newStates, state)
+	}
+
+	return f.write(newStates)
 }
 
-func (f *FSStorageBackend) LoadApps(engine *Engine, session *discordgo.Session) ([]*Instance, error) {
-	data, err := ioutil.ReadFile(f.Path)
+func (f *FSStorageBackend) DeleteInstance(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.ensureRead()
 	if err != nil {
-		if os.IsNotExist(err) {
-			logrus.Info("No apps to load")
-			return nil, nil
+		return err
+	}
+
+	newStates := make([]*SerializedAppState, 0, len(f.states))
+	for _, v := range f.states {
+		if v.ID != id {
+			newStates = append(newStates, v)
 		}
-		return nil, err
 	}
 
-	var decoded []*SerializedAppState
-	err = json.Unmarshal(data, &decoded)
+	if len(newStates) == len(f.states) {
+		// Nothing to delete
+		return nil
+	}
+
+	return f.write(newStates)
+}
+
+func (f *FSStorageBackend) ListInstances() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.ensureRead()
 	if err != nil {
 		return nil, err
 	}
 
-	result := make([]*Instance, 0, len(decoded))
+	ids := make([]string, 0, len(f.states))
+	for _, v := range f.states {
+		ids = append(ids, v.ID)
+	}
+
+	return ids, nil
+}
+
+// ensureRead reads the file if it hasn't been already, f.mu has to be locked
+func (f *FSStorageBackend) ensureRead() error {
+	if f.states != nil {
+		return nil
+	}
+
+	return f.read()
+}
+
+// write replaces the file with the states, f.mu has to be locked
+func (f *FSStorageBackend) write(states []*SerializedAppState) error {
+	allEncoded, err := EncodeWithHeader(f.codec(), states)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(f.Path, allEncoded, !f.primaryCorrupt)
+	if err != nil {
+		return err
+	}
+
+	f.states = states
+	f.primaryCorrupt = false
+	return nil
+}
+
+func (f *FSStorageBackend) codec() Codec {
+	if f.Codec == nil {
+		return JSONCodec{}
+	}
+
+	return f.Codec
+}
+
+// BackupPath returns the path the previous generation of the file is kept at
+func (f *FSStorageBackend) BackupPath() string {
+	return f.Path + ".bak"
+}
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and renames it into place
+// so that a crash never leaves a partially written file behind
+// If keepBackup is set the file previously at path is kept as a backup
+func writeFileAtomic(path string, data []byte, keepBackup bool) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
 
-	for _, sas := range decoded {
-		t, ok := RegisteredApps[sas.AppID]
-		if !ok {
-			logrus.WithField("app_id", sas.AppID).Warn("Unknown app id")
-			continue
+	if keepBackup {
+		// The current file stays in place until the rename below replaces it, so there's always a file at path
+		err = backupFile(path, path+".bak")
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
 		}
+	}
 
-		appDecoded := reflect.New(t).Interface().(App)
-		instance := &Instance{
-			ChannelID:     sas.ChannelID,
-			GuildID:       sas.GuildID,
-			Actions:       sas.Actions,
-			Session:       session,
-			Engine:        engine,
-			UserIDs:       sas.Users,
-			AllowAllUsers: sas.AllowAllUsers,
-			IdleTimeout:   sas.IdleTimeout,
-			LastAction:    sas.LastAction,
-
-			App: appDecoded,
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Make sure the renames themselves are persisted
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// backupFile replaces backup with a hard link to (or if that's not possible, a copy of) path, it's not a error if path does not exist
+func backupFile(path, backup string) error {
+	tmp := backup + ".tmp"
+	os.Remove(tmp)
+
+	err := os.Link(path, tmp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
 
-		err = appDecoded.LoadState(instance, sas.AppData)
+		err = copyFile(path, tmp)
 		if err != nil {
-			logrus.WithError(err).Error("Failed loading app state")
-			continue
+			os.Remove(tmp)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
 		}
+	}
+
+	return os.Rename(tmp, backup)
+}
+
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
 
-		result = append(result, instance)
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// readStates reads and decodes the saved states at path
+func readStates(path string) ([]*SerializedAppState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded []*SerializedAppState
+	err = DecodeWithHeader(data, &decoded)
+	return decoded, err
+}
+
+// read reads the file, falling back to the backup if it's corrupt, f.mu has to be locked
+func (f *FSStorageBackend) read() error {
+	decoded, err := readStates(f.Path)
+	if err != nil {
+		backupDecoded, backupErr := readStates(f.BackupPath())
+		if backupErr != nil {
+			if os.IsNotExist(err) && os.IsNotExist(backupErr) {
+				logrus.Info("No apps to load")
+				f.states = []*SerializedAppState{}
+				return nil
+			}
+
+			if os.IsNotExist(err) {
+				return backupErr
+			}
+
+			return err
+		}
+
+		logrus.WithError(err).Warn("Failed loading apps, loaded the backup instead")
+		decoded = backupDecoded
+	}
 
-		session.ChannelMessageSend(sas.ChannelID, "Engine has now started again and will act on reactions again.")
+	if decoded == nil {
+		decoded = []*SerializedAppState{}
 	}
 
-	return result, nil
+	// A missing file is not corrupt, but there's nothing to rotate then anyways
+	f.primaryCorrupt = err != nil
+	f.states = decoded
+	return nil
 }
@@ -0,0 +1,136 @@
+package drai
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func fsTestState(id string) *SerializedAppState {
+	return &SerializedAppState{
+		ID:        id,
+		AppID:     "test",
+		ChannelID: "c",
+		GuildID:   "g",
+		AppData:   []byte(`{}`),
+	}
+}
+
+func stateIDs(states []*SerializedAppState) []string {
+	ids := make([]string, 0, len(states))
+	for _, v := range states {
+		ids = append(ids, v.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func expectStatesAt(t *testing.T, path string, ids ...string) {
+	t.Helper()
+
+	states, err := readStates(path)
+	if err != nil {
+		t.Fatal("Failed reading", path, err)
+	}
+
+	if got := stateIDs(states); !equalStrings(got, ids) {
+		t.Fatalf("Expected %v in %s, got %v", ids, filepath.Base(path), got)
+	}
+}
+
+func TestFSStorageBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drai_apps.json")
+	b := &FSStorageBackend{Path: path}
+
+	err := b.SaveApps([]*SerializedAppState{fsTestState("1")})
+	if err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	err = b.SaveInstance(fsTestState("2"))
+	if err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	// The previous generation is kept
+	expectStatesAt(t, path, "1", "2")
+	expectStatesAt(t, b.BackupPath(), "1")
+
+	err = b.DeleteInstance("1")
+	if err != nil {
+		t.Fatal("DeleteInstance:", err)
+	}
+
+	expectStatesAt(t, path, "2")
+	expectStatesAt(t, b.BackupPath(), "1", "2")
+
+	// No temporary files left behind
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	if len(files) != 2 {
+		t.Fatal("Expected only the file and its backup, got", files)
+	}
+}
+
+func TestFSStorageCorruptPrimary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drai_apps.json")
+
+	b := &FSStorageBackend{Path: path}
+	b.SaveApps([]*SerializedAppState{fsTestState("1")})
+	b.SaveApps([]*SerializedAppState{fsTestState("1"), fsTestState("2")})
+
+	// Say a disk error corrupted it
+	err := ioutil.WriteFile(path, []byte(`{"garbage`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded by a new backend, as after a restart
+	b = &FSStorageBackend{Path: path}
+	loaded, err := b.LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if ids := stateIDs(loaded); !equalStrings(ids, []string{"1"}) {
+		t.Fatal("Expected the backup to be loaded, got", ids)
+	}
+
+	// The corrupt file is not rotated over the only good copy
+	err = b.SaveInstance(fsTestState("3"))
+	if err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	expectStatesAt(t, path, "1", "3")
+	expectStatesAt(t, b.BackupPath(), "1")
+
+	// Once the file is good again it's rotated as usual
+	err = b.DeleteInstance("1")
+	if err != nil {
+		t.Fatal("DeleteInstance:", err)
+	}
+
+	expectStatesAt(t, path, "3")
+	expectStatesAt(t, b.BackupPath(), "1", "3")
+}
+
+func TestFSStorageNoFiles(t *testing.T) {
+	b := &FSStorageBackend{Path: filepath.Join(t.TempDir(), "drai_apps.json")}
+
+	loaded, err := b.LoadApps()
+	if err != nil || len(loaded) != 0 {
+		t.Fatal("Expected no apps and no error, got", loaded, err)
+	}
+
+	// Nothing to back up on the first write
+	err = b.SaveInstance(fsTestState("1"))
+	if err != nil {
+		t.Fatal("SaveInstance:", err)
+	}
+
+	expectStatesAt(t, b.Path, "1")
+	if _, err := readStates(b.BackupPath()); err == nil {
+		t.Fatal("Expected no backup after the first write")
+	}
+}
@@ -0,0 +1,323 @@
+package drai
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Transport is how a instance's actions are shown to and used by users
+// Apps don't have to care which one is used, actions are handled the same way regardless
+type Transport int
+
+const (
+	// Actions are reactions on their message
+	TransportReactions Transport = iota
+	// Actions are buttons on their message, up to 25 per message
+	TransportButtons
+	// Actions are options in a select menu on their message, up to 25 per message
+	TransportSelectMenu
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportReactions:
+		return "Reactions"
+	case TransportButtons:
+		return "Buttons"
+	case TransportSelectMenu:
+		return "SelectMenu"
+	}
+
+	return "Unknown"
+}
+
+var (
+	ErrActionNoEmoji         = errors.New("Actions need a emoji when using the button or select menu transport")
+	ErrDuplicateActionEmojis = errors.New("Actions on the same message need different emojis when using the button or select menu transport")
+)
+
+const (
+	// Custom ids of our components start with this, followed by the emoji key of the action for buttons
+	componentIDPrefix = "drai:"
+	// Custom id of the select menu, the values of the options are the emoji keys of the actions
+	selectMenuCustomID = componentIDPrefix + "select"
+
+	maxComponentActions = 25
+)
+
+func buttonCustomID(emoji Emoji) string {
+	return componentIDPrefix + emoji.key()
+}
+
+// validateComponentActions returns a error if the actions can't be shown as components
+// The emoji identifies the action in the custom ids and select menu values, and discord rejects the whole message
+// if two components on it have the same id or one has a empty emoji
+func validateComponentActions(actions []*Action) error {
+	seen := make(map[string]bool, len(actions))
+	for _, a := range actions {
+		if a.Emoji.key() == "" {
+			return ErrActionNoEmoji
+		}
+
+		key := actionKey(a.MessageID, a.Emoji.key())
+		if seen[key] {
+			return ErrDuplicateActionEmojis
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// buildComponents creates the components showing the actions with the transport
+func buildComponents(transport Transport, actions []*Action) []discordgo.MessageComponent {
+	components := []discordgo.MessageComponent{}
+	if len(actions) < 1 {
+		return components
+	}
+
+	if len(actions) > maxComponentActions {
+		logrus.WithField("actions", len(actions)).Warn("Too many actions on one message, only showing the first 25")
+		actions = actions[:maxComponentActions]
+	}
+
+	if transport == TransportSelectMenu {
+		options := make([]discordgo.SelectMenuOption, 0, len(actions))
+		for _, a := range actions {
+			label := a.Label
+			if label == "" {
+				label = a.Emoji.Name
+			}
+
+			options = append(options, discordgo.SelectMenuOption{
+				Label: label,
+				Value: a.Emoji.key(),
+				Emoji: componentEmoji(a.Emoji),
+			})
+		}
+
+		return append(components, discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					CustomID: selectMenuCustomID,
+					Options:  options,
+				},
+			},
+		})
+	}
+
+	// 5 buttons per row
+	for len(actions) > 0 {
+		n := len(actions)
+		if n > 5 {
+			n = 5
+		}
+
+		row := discordgo.ActionsRow{}
+		for _, a := range actions[:n] {
+			style := a.ButtonStyle
+			if style == 0 {
+				// Discord rejects buttons without a style
+				style = discordgo.SecondaryButton
+			}
+
+			row.Components = append(row.Components, discordgo.Button{
+				Label:    a.Label,
+				Style:    style,
+				Emoji:    componentEmoji(a.Emoji),
+				CustomID: buttonCustomID(a.Emoji),
+			})
+		}
+
+		components = append(components, row)
+		actions = actions[n:]
+	}
+
+	return components
+}
+
+func componentEmoji(e Emoji) *discordgo.ComponentEmoji {
+	return &discordgo.ComponentEmoji{Name: e.Name, ID: e.ID, Animated: e.Animated}
+}
+
+// renderComponents replaces the components on the message with the instance's actions on it, the instance has to be locked
+func (i *Instance) renderComponents(messageID string) error {
+	var actions []*Action
+	for _, a := range i.Actions {
+		if a.MessageID == messageID {
+			actions = append(actions, a)
+		}
+	}
+
+	components := buildComponents(i.Transport, actions)
+	_, err := i.Session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         messageID,
+		Channel:    i.ChannelID,
+		Components: &components,
+	})
+	return err
+}
+
+// showActions shows the actions on discord using the instance's transport, the instance has to be locked
+func (i *Instance) showActions(actions []*Action) error {
+	if i.Transport == TransportReactions {
+		for _, v := range actions {
+			err := i.Session.MessageReactionAdd(i.ChannelID, v.MessageID, v.Emoji.APIName())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, msgID := range actionMessages(actions) {
+		err := i.renderComponents(msgID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hideActions removes the actions from discord, the instance has to be locked and the actions already removed from it
+// all should be true if all actions on their messages were removed
+func (i *Instance) hideActions(actions []*Action, all bool) {
+	if i.Transport == TransportReactions {
+		if all {
+			for _, msgID := range actionMessages(actions) {
+				i.Session.MessageReactionsRemoveAll(i.ChannelID, msgID)
+			}
+			return
+		}
+
+		// TODO: Remove all users reactions
+		for _, v := range actions {
+			i.Session.MessageReactionRemove(i.ChannelID, v.MessageID, v.Emoji.APIName(), "@me")
+		}
+		return
+	}
+
+	// Only the remaining actions on the messages are shown
+	for _, msgID := range actionMessages(actions) {
+		err := i.renderComponents(msgID)
+		if err != nil {
+			logrus.WithError(err).Error("Failed updating components")
+		}
+	}
+}
+
+// SetTransport switches the transport of the instance, moving all current actions to the new one
+// Note: If called outside of Start, Exit, or action callbacks, then you need to the instance to avoid race conditions
+func (i *Instance) SetTransport(transport Transport) error {
+	if i.Transport == transport {
+		return nil
+	}
+
+	if transport != TransportReactions {
+		err := validateComponentActions(i.Actions)
+		if err != nil {
+			return errors.WithMessage(err, "SetTransport")
+		}
+	}
+
+	actions := i.Actions
+
+	// Hidden as if they were all removed
+	i.Actions = nil
+	i.hideActions(actions, true)
+	i.Actions = actions
+
+	i.Transport = transport
+	i.dirty = true
+
+	return errors.WithMessage(i.showActions(actions), "SetTransport")
+}
+
+// actionMessages returns the ids of the messages the actions are on
+func actionMessages(actions []*Action) []string {
+	ids := make([]string, 0, 1)
+	for _, a := range actions {
+		if !containsString(ids, a.MessageID) {
+			ids = append(ids, a.MessageID)
+		}
+	}
+
+	return ids
+}
+
+// HandleInteractionCreate is supposed to be added as a discord handler
+// it handles the buttons and select menus of instances using those transports, other interactions are ignored
+func (e *Engine) HandleInteractionCreate(s *discordgo.Session, ic *discordgo.InteractionCreate) {
+	if ic.Type != discordgo.InteractionMessageComponent || ic.Message == nil {
+		return
+	}
+
+	data := ic.MessageComponentData()
+	if !strings.HasPrefix(data.CustomID, componentIDPrefix) {
+		// Not ours
+		return
+	}
+
+	var keys []string
+	if data.CustomID == selectMenuCustomID {
+		keys = data.Values
+	} else {
+		keys = []string{strings.TrimPrefix(data.CustomID, componentIDPrefix)}
+	}
+
+	var userID string
+	if ic.Member != nil && ic.Member.User != nil {
+		userID = ic.Member.User.ID
+	} else if ic.User != nil {
+		userID = ic.User.ID
+	} else {
+		return
+	}
+
+	e.RLock()
+	if e.Stopped {
+		e.RUnlock()
+		return
+	}
+
+	targets := copyInstances(e.index.byMessage[ic.Message.ID])
+	e.RUnlock()
+
+	if len(targets) < 1 {
+		return
+	}
+
+	// Has to be acknowledged within 3 seconds, so don't wait for the queue
+	// The app updates the message itself if it wants to
+	err := targets[0].Session.InteractionRespond(ic.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed acknowledging interaction")
+	}
+
+	messageID := ic.Message.ID
+	for _, instance := range targets {
+		inst := instance
+		inst.queue.push(func() {
+			inst.handleComponent(userID, messageID, keys)
+		})
+	}
+}
+
+// handleComponent uses the actions with the emoji keys on the message, same as if the user reacted with them
+func (i *Instance) handleComponent(userID, messageID string, keys []string) {
+	for _, key := range keys {
+		i.RLock()
+		action := i.actionsByKey[actionKey(messageID, key)]
+		i.RUnlock()
+
+		if action != nil {
+			i.useAction(userID, action, true, false)
+		}
+	}
+}
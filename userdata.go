@@ -0,0 +1,269 @@
+package drai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"sort"
+	"time"
+)
+
+// UserDataMap holds the values of UserData, it's encoded as a list of entries tagged with the type of the value
+// so they're restored as the same type, e.g ints don't come back as float64 from json
+type UserDataMap map[string]interface{}
+
+type userDataEntry struct {
+	Key   string          `json:"k"`
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+func (m UserDataMap) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	entries := make([]userDataEntry, 0, len(m))
+	for _, k := range keys {
+		t, v, err := encodeUserDataValue(m[k])
+		if err != nil {
+			return nil, errors.New("Failed encoding user data " + k + ": " + err.Error())
+		}
+
+		entries = append(entries, userDataEntry{Key: k, Type: t, Value: v})
+	}
+
+	return json.Marshal(entries)
+}
+
+func (m *UserDataMap) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*m = nil
+		return nil
+	}
+
+	// Saved before values had types
+	if len(data) > 0 && data[0] == '{' {
+		var legacy map[string]interface{}
+		err := json.Unmarshal(data, &legacy)
+		*m = UserDataMap(legacy)
+		return err
+	}
+
+	var entries []userDataEntry
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+
+	decoded := make(UserDataMap, len(entries))
+	for _, e := range entries {
+		v, err := decodeUserDataValue(e.Type, e.Value)
+		if err != nil {
+			return errors.New("Failed decoding user data " + e.Key + ": " + err.Error())
+		}
+
+		decoded[e.Key] = v
+	}
+
+	*m = decoded
+	return nil
+}
+
+// gob and msgpack use the json encoding as well, so all codecs restore the same types
+
+func (m UserDataMap) GobEncode() ([]byte, error) {
+	return m.MarshalJSON()
+}
+
+func (m *UserDataMap) GobDecode(data []byte) error {
+	return m.UnmarshalJSON(data)
+}
+
+func (m UserDataMap) EncodeMsgpack(enc *msgpack.Encoder) error {
+	encoded, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	return enc.EncodeBytes(encoded)
+}
+
+func (m *UserDataMap) DecodeMsgpack(dec *msgpack.Decoder) error {
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case nil:
+		*m = nil
+	case []byte:
+		return m.UnmarshalJSON(t)
+	case map[string]interface{}:
+		// Saved before values had types
+		*m = UserDataMap(t)
+	default:
+		return errors.New("Invalid user data")
+	}
+
+	return nil
+}
+
+func encodeUserDataValue(v interface{}) (string, json.RawMessage, error) {
+	var t string
+	switch c := v.(type) {
+	case nil:
+		t = "nil"
+	case string:
+		t = "string"
+	case bool:
+		t = "bool"
+	case int:
+		t = "int"
+	case int8:
+		t = "int8"
+	case int16:
+		t = "int16"
+	case int32:
+		t = "int32"
+	case int64:
+		t = "int64"
+	case uint:
+		t = "uint"
+	case uint8:
+		t = "uint8"
+	case uint16:
+		t = "uint16"
+	case uint32:
+		t = "uint32"
+	case uint64:
+		t = "uint64"
+	case float32:
+		t = "float32"
+	case float64:
+		t = "float64"
+	case []byte:
+		t = "bytes"
+	case time.Time:
+		t = "time"
+	case time.Duration:
+		t = "duration"
+	case []string:
+		t = "strings"
+	case UserData:
+		t = "userdata"
+		v = c.M
+	case *UserData:
+		t = "userdata"
+		if c != nil {
+			v = c.M
+		} else {
+			v = nil
+		}
+	default:
+		// Restored however encoding/json decodes it into a interface{}
+		t = "json"
+	}
+
+	encoded, err := json.Marshal(v)
+	return t, encoded, err
+}
+
+func decodeUserDataValue(t string, data json.RawMessage) (interface{}, error) {
+	var err error
+	switch t {
+	case "nil":
+		return nil, nil
+	case "string":
+		var v string
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "bool":
+		var v bool
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int":
+		var v int
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int8":
+		var v int8
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int16":
+		var v int16
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int32":
+		var v int32
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int64":
+		var v int64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "uint":
+		var v uint
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "uint8":
+		var v uint8
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "uint16":
+		var v uint16
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "uint32":
+		var v uint32
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "uint64":
+		var v uint64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "float32":
+		var v float32
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "float64":
+		var v float64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "duration":
+		var v time.Duration
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "strings":
+		var v []string
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "userdata":
+		var v UserData
+		err = json.Unmarshal(data, &v.M)
+		return v, err
+	case "json":
+		var v interface{}
+		err = json.Unmarshal(data, &v)
+		return v, err
+	}
+
+	return nil, errors.New("Unknown type: " + t)
+}
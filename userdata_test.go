@@ -0,0 +1,142 @@
+package drai
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// reloadUserData saves ud on a action through a fs backend and loads it again with a new one, as after a restart
+func reloadUserData(t *testing.T, codec Codec, ud UserData) UserData {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "drai_apps.json")
+	state := fsTestState("1")
+	state.Actions = []*Action{{UserData: ud, Emoji: UnicodeEmoji("👍"), MessageID: "m1"}}
+
+	err := (&FSStorageBackend{Path: path, Codec: codec}).SaveApps([]*SerializedAppState{state})
+	if err != nil {
+		t.Fatal("SaveApps:", err)
+	}
+
+	loaded, err := (&FSStorageBackend{Path: path}).LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if len(loaded) != 1 || len(loaded[0].Actions) != 1 {
+		t.Fatal("Expected 1 state with 1 action, got", loaded)
+	}
+
+	return loaded[0].Actions[0].UserData
+}
+
+func TestUserDataTypes(t *testing.T) {
+	at := time.Unix(1000, 5).UTC()
+
+	nested := UserData{}
+	nested.Set("depth", int64(2))
+	nested.Set("tags", []string{"c"})
+
+	values := map[string]interface{}{
+		"int":      3,
+		"int64":    int64(1) << 40,
+		"bytes":    []byte{0, 1, 255},
+		"time":     at,
+		"duration": time.Minute,
+		"strings":  []string{"a", "b"},
+		"nested":   nested,
+		"string":   "knight",
+		"bool":     true,
+		"float64":  1.5,
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, MsgpackCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			ud := UserData{}
+			for k, v := range values {
+				ud.Set(k, v)
+			}
+
+			loaded := reloadUserData(t, codec, ud)
+			for k, expected := range values {
+				v, ok := loaded.Get(k)
+				if !ok {
+					t.Errorf("%s: missing", k)
+					continue
+				}
+
+				if reflect.TypeOf(v) != reflect.TypeOf(expected) {
+					t.Errorf("%s: expected a %T, got a %T", k, expected, v)
+					continue
+				}
+
+				if k == "time" {
+					if !v.(time.Time).Equal(at) {
+						t.Errorf("%s: expected %v, got %v", k, at, v)
+					}
+					continue
+				}
+
+				if !reflect.DeepEqual(v, expected) {
+					t.Errorf("%s: expected %#v, got %#v", k, expected, v)
+				}
+			}
+
+			n, _ := loaded.Nested("nested")
+			depth, _ := n.Get("depth")
+			if _, ok := depth.(int64); !ok {
+				t.Errorf("Nested value is a %T, expected int64", depth)
+			}
+		})
+	}
+}
+
+func TestUserDataLegacyFormat(t *testing.T) {
+	// Saved before values had types, as a plain json object
+	path := filepath.Join(t.TempDir(), "drai_apps.json")
+	legacy := `[{"id":"1","app_id":"test","channel_id":"c","guild_id":"g","app_data":{},"actions":[{"MessageID":"m1","M":` +
+		`{"int":3,"time":"1970-01-01T00:16:40.000000005Z","duration":60000000000,"strings":["a","b"],"nested":{"depth":2},"string":"knight","bool":true}}]}]`
+	err := ioutil.WriteFile(path, []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := (&FSStorageBackend{Path: path}).LoadApps()
+	if err != nil {
+		t.Fatal("LoadApps:", err)
+	}
+
+	if len(loaded) != 1 || len(loaded[0].Actions) != 1 {
+		t.Fatal("Expected 1 state with 1 action, got", loaded)
+	}
+
+	// The values come back as json decoded them, the typed getters still work
+	ud := loaded[0].Actions[0].UserData
+	i, iok := ud.Int("int")
+	at, tok := ud.Time("time")
+	d, dok := ud.Duration("duration")
+	strs, sok := ud.StringSlice("strings")
+	str, _ := ud.Str("string")
+	b, _ := ud.Bool("bool")
+	if !iok || i != 3 || !tok || !at.Equal(time.Unix(1000, 5)) || !dok || d != time.Minute || !sok || !equalStrings(strs, []string{"a", "b"}) || str != "knight" || !b {
+		t.Fatalf("Legacy values not read back: %#v", ud.M)
+	}
+
+	n, ok := ud.Nested("nested")
+	depth, _ := n.Int("depth")
+	if !ok || depth != 2 {
+		t.Fatalf("Legacy nested user data not read back: %#v", ud.M)
+	}
+
+	// And still after being saved again in the typed format
+	ud = reloadUserData(t, JSONCodec{}, ud)
+	i, _ = ud.Int("int")
+	n, _ = ud.Nested("nested")
+	depth, _ = n.Int("depth")
+	if i != 3 || depth != 2 {
+		t.Fatalf("Legacy values lost after saving again: %#v", ud.M)
+	}
+}
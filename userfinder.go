@@ -27,16 +27,33 @@ func (u *UserFinder) Start() error {
 	}
 
 	u.AddAction = &Action{
-		Emoji:     "➕",
+		Emoji:     UnicodeEmoji("➕"),
 		MessageID: u.MessageID,
+
+		// Only shown with the button and select menu transports
+		Label:       "Join",
+		ButtonStyle: discordgo.SuccessButton,
 	}
 
 	u.RemoveAction = &Action{
-		Emoji:     "➖",
+		Emoji:     UnicodeEmoji("➖"),
 		MessageID: u.MessageID,
+
+		Label:       "Leave",
+		ButtonStyle: discordgo.DangerButton,
+	}
+
+	err = u.Instance.AddActions(u.AddAction, u.RemoveAction)
+	if err != nil {
+		return err
 	}
 
-	return u.Instance.AddActions(u.AddAction, u.RemoveAction)
+	// Everyone may already be here, such as when they were picked when starting the app
+	if len(u.Users) >= u.NumUsersToFind {
+		go u.DelayedCallDB()
+	}
+
+	return nil
 }
 
 func (u *UserFinder) UpdateMessage() error {
@@ -49,7 +66,14 @@ func (u *UserFinder) UpdateMessage() error {
 		}
 	}
 
-	content += "```\nReact with ➕ to join, and ➖ to leave.\n"
+	switch u.Instance.Transport {
+	case TransportButtons:
+		content += "```\nPress ➕ Join to join, and ➖ Leave to leave.\n"
+	case TransportSelectMenu:
+		content += "```\nSelect ➕ Join to join, and ➖ Leave to leave.\n"
+	default:
+		content += "```\nReact with ➕ to join, and ➖ to leave.\n"
+	}
 
 	if len(u.Users) >= u.NumUsersToFind {
 		content += "\nAll users found! Starting in 1 second..."
@@ -81,6 +105,21 @@ func (u *UserFinder) HandleAction(userID string, action *Action) (handled bool,
 	return
 }
 
+// HandleActionToggle is the same as HandleAction but also treats removing the ➕ reaction as leaving
+// Use this instead of HandleAction if your app implements ToggleApp
+func (u *UserFinder) HandleActionToggle(userID string, action *Action, added bool) (handled bool, err error) {
+	if added {
+		return u.HandleAction(userID, action)
+	}
+
+	if action.Equal(u.AddAction) {
+		handled = true
+		err = u.onActionRemove(userID, action)
+	}
+
+	return
+}
+
 func (u *UserFinder) onActionAdd(userID string, action *Action) error {
 	for _, v := range u.Users {
 		if v.ID == userID {
@@ -121,6 +160,7 @@ func (u *UserFinder) DelayedCallDB() {
 	if len(u.Users) >= u.NumUsersToFind && !u.UsersFoundCalled {
 		u.UsersFoundCB(u.Users)
 		u.UsersFoundCalled = true
+		u.Instance.MarkDirty()
 
 		u.Instance.RemoveActions(u.AddAction, u.RemoveAction)
 	}